@@ -0,0 +1,411 @@
+package traefik_token_injector
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceError is the last error that occurred for a service
+type ServiceError struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// ServiceErrors keeps the last error of each service
+type ServiceErrors struct {
+	mu     sync.Mutex
+	errors map[string]ServiceError
+}
+
+// NewServiceErrors creates an empty error log
+func NewServiceErrors() *ServiceErrors {
+	return &ServiceErrors{errors: make(map[string]ServiceError)}
+}
+
+// Record stores err as the last error of a service
+func (e *ServiceErrors) Record(serviceId string, err error) {
+	if serviceId == "" {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errors[serviceId] = ServiceError{Error: redactSecrets(err.Error()), Time: time.Now()}
+}
+
+// All returns a copy of the last errors keyed by service ID
+func (e *ServiceErrors) All() map[string]ServiceError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	all := make(map[string]ServiceError, len(e.errors))
+	for serviceId, serviceErr := range e.errors {
+		all[serviceId] = serviceErr
+	}
+	return all
+}
+
+var (
+	adminMu sync.Mutex
+
+	// adminInjectors holds the middlewares of the process exposed by the admin API, keyed by name
+	adminInjectors = make(map[string]*TokenInjector)
+
+	// adminServers holds the admin listeners shared by all middlewares of the process, keyed by address
+	adminServers = make(map[string]*adminServer)
+)
+
+// adminServer is a separate admin listener
+type adminServer struct {
+	server *http.Server
+	refs   int
+}
+
+// registerInjector exposes a middleware through the admin API
+// A middleware replaced by a configuration reload is superseded by the new one of the same name
+func registerInjector(injector *TokenInjector) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	adminInjectors[injector.name] = injector
+}
+
+// unregisterInjector removes a stopped middleware from the admin API
+func unregisterInjector(injector *TokenInjector) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if adminInjectors[injector.name] == injector {
+		delete(adminInjectors, injector.name)
+	}
+}
+
+// registeredInjectors returns the middlewares exposed by the admin API sorted by name
+func registeredInjectors() []*TokenInjector {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	injectors := make([]*TokenInjector, 0, len(adminInjectors))
+	for _, injector := range adminInjectors {
+		injectors = append(injectors, injector)
+	}
+	sort.Slice(injectors, func(i, j int) bool { return injectors[i].name < injectors[j].name })
+	return injectors
+}
+
+// AcquireAdminServer starts the admin listener shared by all middlewares using the same address on first use
+// Call ReleaseAdminServer when the middleware is stopped.
+func AcquireAdminServer(config *AdminConfig) error {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	if server, ok := adminServers[config.Listen]; ok {
+		server.refs++
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", config.Listen, err)
+	}
+
+	server := &adminServer{server: &http.Server{Handler: NewAdminHandler(config)}, refs: 1}
+	adminServers[config.Listen] = server
+
+	go func() {
+		if err := server.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			rootLogger.Error("Admin listener failed", "address", config.Listen, "error", err)
+		}
+	}()
+	rootLogger.Info("Admin API listening", "address", config.Listen, "pathPrefix", config.PathPrefix)
+	return nil
+}
+
+// ReleaseAdminServer releases the admin listener, closing it when no middleware uses it anymore
+func ReleaseAdminServer(config *AdminConfig) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	server, ok := adminServers[config.Listen]
+	if !ok {
+		return
+	}
+	server.refs--
+	if server.refs > 0 {
+		return
+	}
+
+	server.server.Close()
+	delete(adminServers, config.Listen)
+}
+
+// AdminHandler serves the admin API for all middlewares of the process
+//
+//	GET    {prefix}/metrics                metrics in the Prometheus text format
+//	GET    {prefix}/cache                  cached tokens (redacted) and cache counters
+//	GET    {prefix}/errors                 last error per service
+//	GET    {prefix}/ready                  readiness per middleware and service, 503 unless all are ready
+//	GET    {prefix}/services/{id}          cached tokens and last errors of a service
+//	DELETE {prefix}/services/{id}/token    evict the cached tokens of a service
+//	POST   {prefix}/services/{id}/refresh  evict and obtain a new token for a service
+//	POST   {prefix}/services/{id}/reload   re-fetch the instance metadata of a service
+type AdminHandler struct {
+	prefix string
+	token  string
+}
+
+// NewAdminHandler creates the admin API handler
+func NewAdminHandler(config *AdminConfig) *AdminHandler {
+	return &AdminHandler{
+		prefix: strings.TrimSuffix(config.PathPrefix, "/"),
+		token:  config.GetToken(),
+	}
+}
+
+// Matches reports whether a request targets the admin API
+func (a *AdminHandler) Matches(req *http.Request) bool {
+	return req.URL.Path == a.prefix || strings.HasPrefix(req.URL.Path, a.prefix+"/")
+}
+
+// adminCacheEntry is a cached token as reported by the admin API
+type adminCacheEntry struct {
+	Middleware string `json:"middleware"`
+	Key        string `json:"key"`
+	ServiceId  string `json:"serviceId"`
+	Token      string `json:"token"` // Redacted
+	ExpiresAt  *int64 `json:"expiresAt"`
+	RefreshAt  *int64 `json:"refreshAt"`
+	Source     string `json:"source"`
+	VersionId  string `json:"versionId"`
+}
+
+// adminServiceError is the last error of a service in a middleware as reported by the admin API
+type adminServiceError struct {
+	Middleware string    `json:"middleware"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+// ServeHTTP implements the http.Handler interface
+func (a *AdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		writeAdminJSON(rw, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, a.prefix), "/")
+	segments := strings.Split(path, "/")
+
+	switch {
+	case path == "metrics" && req.Method == http.MethodGet:
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(rw)
+	case path == "cache" && req.Method == http.MethodGet:
+		a.serveCache(rw)
+	case path == "errors" && req.Method == http.MethodGet:
+		writeAdminJSON(rw, http.StatusOK, collectServiceErrors(""))
+	case path == "ready" && req.Method == http.MethodGet:
+		a.serveReady(rw)
+	case len(segments) == 3 && segments[0] == "services" && segments[1] != "":
+		serviceId := segments[1]
+		switch {
+		case segments[2] == "token" && req.Method == http.MethodDelete:
+			a.serveEvict(rw, serviceId)
+		case segments[2] == "refresh" && req.Method == http.MethodPost:
+			a.serveRefresh(rw, serviceId)
+		case segments[2] == "reload" && req.Method == http.MethodPost:
+			a.serveReload(rw, serviceId)
+		default:
+			writeAdminJSON(rw, http.StatusNotFound, map[string]string{"error": "not found"})
+		}
+	case len(segments) == 2 && segments[0] == "services" && segments[1] != "" && req.Method == http.MethodGet:
+		a.serveService(rw, segments[1])
+	default:
+		writeAdminJSON(rw, http.StatusNotFound, map[string]string{"error": "not found"})
+	}
+}
+
+// authorized checks the bearer token of an admin request in constant time
+func (a *AdminHandler) authorized(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// serveCache lists the cached tokens and the cache counters of every middleware
+func (a *AdminHandler) serveCache(rw http.ResponseWriter) {
+	stats := make(map[string]CacheStats)
+	for _, injector := range registeredInjectors() {
+		stats[injector.name] = injector.cache.Stats()
+	}
+
+	writeAdminJSON(rw, http.StatusOK, map[string]interface{}{
+		"entries": collectCacheEntries(""),
+		"stats":   stats,
+	})
+}
+
+// serveReady reports the readiness of the services of every middleware
+func (a *AdminHandler) serveReady(rw http.ResponseWriter) {
+	ready := true
+	middlewares := make(map[string]interface{})
+	for _, injector := range registeredInjectors() {
+		injectorReady := injector.readiness.Ready()
+		ready = ready && injectorReady
+		middlewares[injector.name] = map[string]interface{}{
+			"ready":    injectorReady,
+			"services": injector.readiness.All(),
+		}
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeAdminJSON(rw, status, map[string]interface{}{"ready": ready, "middlewares": middlewares})
+}
+
+// serveService reports the cached tokens and last errors of a service
+func (a *AdminHandler) serveService(rw http.ResponseWriter, serviceId string) {
+	writeAdminJSON(rw, http.StatusOK, map[string]interface{}{
+		"serviceId": serviceId,
+		"entries":   collectCacheEntries(serviceId),
+		"errors":    collectServiceErrors(serviceId)[serviceId],
+	})
+}
+
+// serveEvict evicts the cached tokens of a service from every middleware
+func (a *AdminHandler) serveEvict(rw http.ResponseWriter, serviceId string) {
+	evicted := 0
+	for _, injector := range registeredInjectors() {
+		evicted += injector.cache.DeleteService(serviceId)
+	}
+
+	rootLogger.Audit("Admin evicted cached tokens", "serviceId", serviceId, "count", evicted)
+	writeAdminJSON(rw, http.StatusOK, map[string]interface{}{"serviceId": serviceId, "evicted": evicted})
+}
+
+// serveRefresh obtains a new token for a service in every middleware serving it
+func (a *AdminHandler) serveRefresh(rw http.ResponseWriter, serviceId string) {
+	refreshed := []string{}
+	failed := map[string]string{}
+	for _, injector := range registeredInjectors() {
+		if !injector.servesService(serviceId) {
+			continue
+		}
+		if err := injector.refreshService(serviceId); err != nil {
+			injector.lastErrors.Record(serviceId, err)
+			failed[injector.name] = redactSecrets(err.Error())
+			continue
+		}
+		refreshed = append(refreshed, injector.name)
+	}
+
+	rootLogger.Audit("Admin refreshed token", "serviceId", serviceId, "middlewares", refreshed)
+
+	status := http.StatusOK
+	if len(failed) > 0 {
+		status = http.StatusBadGateway
+	} else if len(refreshed) == 0 {
+		status = http.StatusNotFound
+	}
+	writeAdminJSON(rw, status, map[string]interface{}{"serviceId": serviceId, "refreshed": refreshed, "errors": failed})
+}
+
+// serveReload re-fetches the instance metadata of a service in every middleware serving it
+// and drops the stale copies they hold
+func (a *AdminHandler) serveReload(rw http.ResponseWriter, serviceId string) {
+	reloaded := []string{}
+	failed := map[string]string{}
+	var instance *InstanceType
+	for _, injector := range registeredInjectors() {
+		if !injector.servesService(serviceId) {
+			continue
+		}
+		fetched, err := injector.reloadService(serviceId)
+		if err != nil {
+			injector.lastErrors.Record(serviceId, err)
+			failed[injector.name] = redactSecrets(err.Error())
+			continue
+		}
+		instance = fetched
+		reloaded = append(reloaded, injector.name)
+	}
+
+	rootLogger.Audit("Admin reloaded instance metadata", "serviceId", serviceId, "middlewares", reloaded)
+
+	status := http.StatusOK
+	if len(failed) > 0 {
+		status = http.StatusBadGateway
+	} else if len(reloaded) == 0 {
+		status = http.StatusNotFound
+	}
+	response := map[string]interface{}{"serviceId": serviceId, "reloaded": reloaded, "errors": failed}
+	if instance != nil {
+		response["name"] = instance.Name
+		response["versionId"] = instance.VersionID
+		response["updatedAt"] = instance.UpdatedAt
+	}
+	writeAdminJSON(rw, status, response)
+}
+
+// collectCacheEntries returns the cached tokens of a service, or of all services if serviceId is empty
+func collectCacheEntries(serviceId string) []adminCacheEntry {
+	entries := []adminCacheEntry{}
+	for _, injector := range registeredInjectors() {
+		for key, cached := range injector.cache.Entries(serviceId) {
+			entries = append(entries, adminCacheEntry{
+				Middleware: injector.name,
+				Key:        key,
+				ServiceId:  cached.ServiceId,
+				Token:      redactToken(cached.Token),
+				ExpiresAt:  cached.ExpiresAt,
+				RefreshAt:  cached.RefreshAt,
+				Source:     cached.Source,
+				VersionId:  cached.Tag.VersionID,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Middleware != entries[j].Middleware {
+			return entries[i].Middleware < entries[j].Middleware
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// collectServiceErrors returns the last errors of a service, or of all services if serviceId is empty
+func collectServiceErrors(serviceId string) map[string][]adminServiceError {
+	all := make(map[string][]adminServiceError)
+	for _, injector := range registeredInjectors() {
+		for id, serviceErr := range injector.lastErrors.All() {
+			if serviceId != "" && id != serviceId {
+				continue
+			}
+			all[id] = append(all[id], adminServiceError{Middleware: injector.name, Error: serviceErr.Error, Time: serviceErr.Time})
+		}
+	}
+	return all
+}
+
+// redactToken returns a token with all but its first characters masked
+func redactToken(token string) string {
+	if len(token) <= 8 {
+		return "****"
+	}
+	return token[:4] + "****"
+}
+
+// writeAdminJSON writes a JSON response of the admin API
+func writeAdminJSON(rw http.ResponseWriter, statusCode int, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(statusCode)
+	json.NewEncoder(rw).Encode(body)
+}
@@ -2,11 +2,16 @@ package traefik_token_injector
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // AuthHandler handles authentication for different auth types
@@ -14,19 +19,34 @@ type AuthHandler struct {
 	client *http.Client
 	cache  *TokenCache
 	config *GlobalConfig
+	health *EndpointHealth
+
+	// Optional write-back of obtained tokens to the control plane
+	writeBack *TokenWriteBack
 }
 
 // NewAuthHandler creates a new authentication handler
 func NewAuthHandler(cache *TokenCache, config *GlobalConfig) *AuthHandler {
+	// The demotion period is checked by GlobalConfig.Validate, the timeout by NewGraphQLClient
+	demotion, _ := config.GetEndpointDemotion()
+	timeout, _ := config.GetTimeout()
+
 	return &AuthHandler{
-		client: &http.Client{},
+		client: &http.Client{Timeout: timeout},
 		cache:  cache,
 		config: config,
+		health: NewEndpointHealth(config.GetEndpointFailureThreshold(), demotion),
 	}
 }
 
+// UseWriteBack writes tokens obtained from authentication endpoints back to the control plane
+func (h *AuthHandler) UseWriteBack(writeBack *TokenWriteBack) {
+	h.writeBack = writeBack
+}
+
 // GetAuthToken retrieves or generates an authentication token based on the auth type
-func (h *AuthHandler) GetAuthToken(serviceId string, credentials *CredentialsType) (string, error) {
+// Cached tokens are only reused while the instance state identified by tag is unchanged
+func (h *AuthHandler) GetAuthToken(ctx context.Context, serviceId string, credentials *CredentialsType, tag TokenTag) (string, error) {
 	if credentials == nil {
 		return "", fmt.Errorf("credentials are nil")
 	}
@@ -36,7 +56,7 @@ func (h *AuthHandler) GetAuthToken(serviceId string, credentials *CredentialsTyp
 		return h.handleBasicAuth(credentials)
 
 	case "LOGIN":
-		return h.handleLoginAuth(serviceId, credentials)
+		return h.handleLoginAuth(ctx, serviceId, credentials, tag, false)
 
 	case "APITOKEN":
 		return h.handleAPITokenAuth(credentials)
@@ -49,6 +69,15 @@ func (h *AuthHandler) GetAuthToken(serviceId string, credentials *CredentialsTyp
 	}
 }
 
+// RefreshAuthToken obtains a new token, skipping the cached token and the token provided by the control plane
+// The new token replaces the cached one; auth types without a login return the same value as GetAuthToken
+func (h *AuthHandler) RefreshAuthToken(ctx context.Context, serviceId string, credentials *CredentialsType, tag TokenTag) (string, error) {
+	if credentials != nil && credentials.AuthType == "LOGIN" {
+		return h.handleLoginAuth(ctx, serviceId, credentials, tag, true)
+	}
+	return h.GetAuthToken(ctx, serviceId, credentials, tag)
+}
+
 // handleBasicAuth creates a Basic Authentication header value
 func (h *AuthHandler) handleBasicAuth(credentials *CredentialsType) (string, error) {
 	// Find username and password in credential data
@@ -74,113 +103,369 @@ func (h *AuthHandler) handleBasicAuth(credentials *CredentialsType) (string, err
 }
 
 // handleLoginAuth calls the authentication endpoint to obtain a token
-func (h *AuthHandler) handleLoginAuth(serviceId string, credentials *CredentialsType) (string, error) {
+// With force the cached token and the token provided by the control plane are ignored
+func (h *AuthHandler) handleLoginAuth(ctx context.Context, serviceId string, credentials *CredentialsType, tag TokenTag, force bool) (string, error) {
+	// Tokens are cached per service and credentials
+	cacheKey := CacheKey(serviceId, credentials)
+
+	// Writing a token back changes the instance updated_at, which must not invalidate that token
+	tag = h.writeBack.OwnTag(serviceId, tag)
+
+	// Token due for refresh, which must not be reused even if the control plane provides it
+	var staleToken string
+
 	// Check cache first
-	if h.config.CacheEnabled {
-		token, needsRefresh, exists := h.cache.Get(serviceId, h.config.TokenRefreshBuffer)
+	if h.config.CacheEnabled && !force {
+		_, lookupSpan := StartSpan(ctx, "cache_lookup", SpanKindInternal)
+		token, needsRefresh, exists := h.cache.Get(cacheKey, h.config.TokenRefreshBuffer, tag)
+		lookupSpan.SetAttribute("cache.hit", strconv.FormatBool(exists && !needsRefresh))
+		lookupSpan.End()
 		if exists && !needsRefresh {
 			return token, nil
 		}
+		if needsRefresh {
+			staleToken = token
+		}
+
+		// Only one replica sharing the cache refreshes a token at a time
+		release, acquired := h.cache.AcquireRefresh(cacheKey)
+		if acquired {
+			defer release()
+
+			// The token may have been refreshed while waiting for the lock
+			if token, needsRefresh, exists := h.cache.Get(cacheKey, h.config.TokenRefreshBuffer, tag); exists && !needsRefresh {
+				return token, nil
+			}
+		} else {
+			// Keep using the current token while another replica refreshes it
+			if exists {
+				return token, nil
+			}
+			if token, ok := h.cache.WaitForRefresh(cacheKey, tag); ok {
+				return token, nil
+			}
+			// The other replica did not store a token in time, obtain one without the lock
+		}
 	}
 
-	// If token exists but doesn't need refresh, use it
-	if credentials.Token != nil && *credentials.Token != "" {
-		// Cache the pre-existing token
+	// Use the pre-existing token while it is valid
+	// A token written back by this plugin is refreshed like any other cached token
+	if ttl, ok := h.controlPlaneTokenTtl(credentials); ok && !force && *credentials.Token != staleToken {
+		// Cache the pre-existing token until it expires
 		if h.config.CacheEnabled {
-			h.cache.Set(serviceId, *credentials.Token, credentials.TokenTtl, h.config.TokenRefreshBuffer)
+			h.cache.Set(cacheKey, serviceId, *credentials.Token, ttl, h.config.TokenRefreshBuffer, tag, TokenSourceControlPlane)
 		}
 		return *credentials.Token, nil
 	}
 
-	// Need to fetch a new token from the authentication endpoint
-	if credentials.EndpointData == nil || len(credentials.EndpointData.Edges) == 0 {
-		return "", fmt.Errorf("no authentication endpoint configured")
-	}
-
-	// Get the first endpoint
-	endpointNode := credentials.EndpointData.Edges[0].Node
+	// Need to fetch a new token from the login chain or the authentication endpoint
+	ctx, span := StartSpan(ctx, "login", SpanKindClient)
+	defer span.End()
+	span.SetAttribute("auth.type", credentials.AuthType)
+	span.SetAttribute("service.id", serviceId)
 
+	start := time.Now()
 	var token string
 	var err error
-
-	// Determine endpoint type and call accordingly
-	if credentials.EndpointType == "REST" && endpointNode.EndpointType != nil {
-		token, err = h.callRESTAuthEndpoint(endpointNode.EndpointType, credentials)
-	} else if credentials.EndpointType == "GRAPHQL" && endpointNode.GqlOperationType != nil {
-		token, err = h.callGraphQLAuthEndpoint(endpointNode.GqlOperationType, credentials)
+	if len(credentials.LoginSteps) > 0 {
+		token, err = h.runLoginChain(ctx, credentials)
+	} else if credentials.EndpointData == nil || len(credentials.EndpointData.Edges) == 0 {
+		return "", fmt.Errorf("no authentication endpoint configured")
 	} else {
-		return "", fmt.Errorf("invalid endpoint configuration")
+		token, err = h.callAuthEndpoints(ctx, serviceId, credentials)
 	}
-
+	loginDuration.ObserveSince(start, credentials.AuthType, serviceId)
 	if err != nil {
+		span.RecordError(rootLogger.WithSecrets(credentialSecrets(credentials)...).RedactError(err))
+		loginAttempts.Inc(credentials.AuthType, serviceId, "failure")
 		return "", fmt.Errorf("failed to obtain token: %w", err)
 	}
+	loginAttempts.Inc(credentials.AuthType, serviceId, "success")
 
 	// Cache the token
 	if h.config.CacheEnabled {
-		h.cache.Set(serviceId, token, credentials.TokenTtl, h.config.TokenRefreshBuffer)
+		h.cache.Set(cacheKey, serviceId, token, credentials.TokenTtl, h.config.TokenRefreshBuffer, tag, TokenSourceLogin)
+	}
+
+	// Store the token on the instance for other consumers of the control plane
+	if h.writeBack != nil {
+		h.writeBack.Enqueue(serviceId, token, credentials.TokenTtl, tag)
 	}
 
 	return token, nil
 }
 
+// controlPlaneTokenTtl reports whether the pre-existing token of the credentials can be used and returns its TTL
+// A token with a stored expiry is only valid until then; with write-back enabled, a token without one
+// may have been written back long ago, so its age is unknown and it is not used
+func (h *AuthHandler) controlPlaneTokenTtl(credentials *CredentialsType) (*int, bool) {
+	if credentials.Token == nil || *credentials.Token == "" {
+		return nil, false
+	}
+	if credentials.TokenExpiresAt == nil {
+		if h.writeBack != nil {
+			return nil, false
+		}
+		return credentials.TokenTtl, true
+	}
+
+	remaining := int(*credentials.TokenExpiresAt - time.Now().Unix())
+	if remaining <= 0 {
+		return nil, false
+	}
+	return &remaining, true
+}
+
+// callAuthEndpoints tries the configured authentication endpoints in order until one returns a token
+// Endpoints that keep failing are demoted and tried last until their demotion expires
+func (h *AuthHandler) callAuthEndpoints(ctx context.Context, serviceId string, credentials *CredentialsType) (string, error) {
+	edges := credentials.EndpointData.Edges
+
+	keys := make([]string, len(edges))
+	for i, edge := range edges {
+		keys[i] = serviceId + "|" + endpointKey(i, edge.Node)
+	}
+
+	var formats []string
+	var failures []interface{}
+	for _, i := range h.health.Order(keys) {
+		endpointNode := edges[i].Node
+
+		token, err := h.callAuthEndpoint(ctx, endpointNode, credentials)
+		if err == nil {
+			h.health.RecordSuccess(keys[i])
+			return token, nil
+		}
+
+		h.health.RecordFailure(keys[i], err)
+		formats = append(formats, "%s: %w")
+		failures = append(failures, describeEndpoint(i, endpointNode), err)
+	}
+
+	// Report the failure of every endpoint while keeping the errors unwrappable
+	if len(formats) == 1 {
+		return "", fmt.Errorf(formats[0], failures...)
+	}
+	args := append([]interface{}{len(formats)}, failures...)
+	return "", fmt.Errorf("all %d authentication endpoints failed: "+strings.Join(formats, "; "), args...)
+}
+
+// callAuthEndpoint calls a single authentication endpoint according to the endpoint type
+func (h *AuthHandler) callAuthEndpoint(ctx context.Context, endpointNode EndpointNode, credentials *CredentialsType) (string, error) {
+	if credentials.EndpointType == "REST" && endpointNode.EndpointType != nil {
+		return h.callRESTAuthEndpoint(ctx, endpointNode.EndpointType, credentials)
+	} else if credentials.EndpointType == "GRAPHQL" && endpointNode.GqlOperationType != nil {
+		return h.callGraphQLAuthEndpoint(ctx, endpointNode.GqlOperationType, credentials)
+	}
+	return "", fmt.Errorf("invalid endpoint configuration")
+}
+
+// endpointKey returns a stable key identifying an endpoint for health tracking
+func endpointKey(index int, node EndpointNode) string {
+	switch {
+	case node.EndpointType != nil && node.EndpointType.ID != "":
+		return node.EndpointType.ID
+	case node.EndpointType != nil:
+		return node.EndpointType.Method + " " + node.EndpointType.Path
+	case node.GqlOperationType != nil && node.GqlOperationType.ID != "":
+		return node.GqlOperationType.ID
+	case node.GqlOperationType != nil:
+		return node.GqlOperationType.OperationType + " " + node.GqlOperationType.Name
+	default:
+		return fmt.Sprintf("#%d", index)
+	}
+}
+
+// describeEndpoint returns a human readable description of an endpoint for error messages
+func describeEndpoint(index int, node EndpointNode) string {
+	switch {
+	case node.EndpointType != nil:
+		return fmt.Sprintf("endpoint %d (%s %s)", index+1, node.EndpointType.Method, node.EndpointType.Path)
+	case node.GqlOperationType != nil:
+		return fmt.Sprintf("endpoint %d (%s %s)", index+1, node.GqlOperationType.OperationType, node.GqlOperationType.Name)
+	default:
+		return fmt.Sprintf("endpoint %d", index+1)
+	}
+}
+
+// authResponse holds the parts of an authentication endpoint response needed to extract values
+type authResponse struct {
+	Body    []byte
+	Header  http.Header
+	Cookies []*http.Cookie
+}
+
+// endpointStatusError is returned when an authentication endpoint responds with an unexpected status code
+// The response body is left out, it may echo the submitted credentials and errors reach the admin API and traces
+type endpointStatusError struct {
+	Endpoint   string
+	StatusCode int
+}
+
+func (e *endpointStatusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.Endpoint, e.StatusCode)
+}
+
+// rejected reports whether the endpoint rejected the submitted credentials
+func (e *endpointStatusError) rejected() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// classifyStatusError wraps a status error in the error type of its cause
+func classifyStatusError(err *endpointStatusError) error {
+	if err.rejected() {
+		return &CredentialsRejectedError{Err: err}
+	}
+	return &AuthEndpointUnavailableError{Err: err}
+}
+
+// totpWindows lists the TOTP windows tried in order: the current one, then the adjacent ones for clock skew
+var totpWindows = []int{0, -1, 1}
+
+// executeResolved resolves TOTP codes in the credential data and calls the endpoint
+// If the endpoint rejects TOTP credentials the call is retried with codes from the adjacent windows
+func (h *AuthHandler) executeResolved(credentialData []CredentialsPairType, call func([]CredentialsPairType) (*authResponse, error)) (*authResponse, error) {
+	windows := totpWindows
+	if !hasTotpCredential(credentialData) {
+		windows = totpWindows[:1]
+	}
+
+	now := time.Now()
+	var lastErr error
+	for _, window := range windows {
+		resolved, err := ResolveCredentialData(credentialData, CredentialResolveOptions{Time: now, TotpWindow: window})
+		if err != nil {
+			return nil, err
+		}
+
+		// Template outputs, TOTP codes and extracted step values are not part of the configured credentials,
+		// so they are redacted here before an endpoint error can carry them into the logs
+		redactor := rootLogger.WithSecrets(credentialPairSecrets(resolved)...)
+		resp, err := call(resolved)
+		if err == nil {
+			return resp, nil
+		}
+		err = redactor.RedactError(err)
+
+		// Only retry when the credentials were rejected, other failures are not caused by clock skew
+		var statusErr *endpointStatusError
+		if !errors.As(err, &statusErr) || !statusErr.rejected() {
+			return nil, err
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
 // callRESTAuthEndpoint calls a REST authentication endpoint
-func (h *AuthHandler) callRESTAuthEndpoint(endpoint *EndpointType, credentials *CredentialsType) (string, error) {
+func (h *AuthHandler) callRESTAuthEndpoint(ctx context.Context, endpoint *EndpointType, credentials *CredentialsType) (string, error) {
+	credentialData, err := ResolveCredentialTemplates(credentials.CredentialData)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := h.executeRESTEndpoint(ctx, endpoint, credentialData)
+	if err != nil {
+		return "", err
+	}
+
+	// Extract token from response
+	token, err := ExtractTokenFromResponse(resp.Body, credentials.TokenLocation)
+	if err != nil {
+		return "", &TokenExtractionError{Err: fmt.Errorf("failed to extract token: %w", err)}
+	}
+
+	return token, nil
+}
+
+// executeRESTEndpoint builds and executes a request against a REST authentication endpoint
+func (h *AuthHandler) executeRESTEndpoint(ctx context.Context, endpoint *EndpointType, credentialData []CredentialsPairType) (*authResponse, error) {
+	return h.executeResolved(credentialData, func(resolved []CredentialsPairType) (*authResponse, error) {
+		return h.sendRESTRequest(ctx, endpoint, resolved)
+	})
+}
+
+// sendRESTRequest sends a single request to a REST authentication endpoint
+func (h *AuthHandler) sendRESTRequest(ctx context.Context, endpoint *EndpointType, credentialData []CredentialsPairType) (*authResponse, error) {
 	// Build the request
-	method, url, body, headers, err := BuildRESTRequest(endpoint, credentials.CredentialData, "")
+	method, url, body, headers, err := BuildRESTRequest(endpoint, credentialData, "")
 	if err != nil {
-		return "", fmt.Errorf("failed to build REST request: %w", err)
+		return nil, fmt.Errorf("failed to build REST request: %w", err)
 	}
 
 	// Create HTTP request
 	var req *http.Request
 	if body != nil {
-		req, err = http.NewRequest(method, url, bytes.NewBuffer(body))
+		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
 	} else {
-		req, err = http.NewRequest(method, url, nil)
+		req, err = http.NewRequestWithContext(ctx, method, url, nil)
 	}
 	if err != nil {
-		return "", fmt.Errorf("failed to create HTTP request: %w", err)
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
 
 	// Set headers
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
+	InjectTraceparent(ctx, req.Header)
 
 	// Execute request
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to execute request: %w", err)
+		return nil, &AuthEndpointUnavailableError{Err: fmt.Errorf("failed to execute request: %w", err)}
 	}
 	defer resp.Body.Close()
 
 	// Read response
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		return nil, &AuthEndpointUnavailableError{Err: fmt.Errorf("failed to read response: %w", err)}
 	}
 
 	// Check status code
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return "", fmt.Errorf("authentication endpoint returned status %d: %s", resp.StatusCode, string(respBody))
+		return nil, classifyStatusError(&endpointStatusError{Endpoint: "authentication endpoint", StatusCode: resp.StatusCode})
+	}
+
+	return &authResponse{Body: respBody, Header: resp.Header, Cookies: resp.Cookies()}, nil
+}
+
+// callGraphQLAuthEndpoint calls a GraphQL authentication endpoint
+func (h *AuthHandler) callGraphQLAuthEndpoint(ctx context.Context, operation *GqlOperationType, credentials *CredentialsType) (string, error) {
+	credentialData, err := ResolveCredentialTemplates(credentials.CredentialData)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := h.executeGraphQLEndpoint(ctx, operation, credentialData)
+	if err != nil {
+		return "", err
 	}
 
 	// Extract token from response
-	token, err := ExtractTokenFromResponse(respBody, credentials.TokenLocation)
+	token, err := ExtractTokenFromResponse(resp.Body, credentials.TokenLocation)
 	if err != nil {
-		return "", fmt.Errorf("failed to extract token: %w", err)
+		return "", &TokenExtractionError{Err: fmt.Errorf("failed to extract token: %w", err)}
 	}
 
 	return token, nil
 }
 
-// callGraphQLAuthEndpoint calls a GraphQL authentication endpoint
-func (h *AuthHandler) callGraphQLAuthEndpoint(operation *GqlOperationType, credentials *CredentialsType) (string, error) {
+// executeGraphQLEndpoint builds and executes a GraphQL authentication operation
+func (h *AuthHandler) executeGraphQLEndpoint(ctx context.Context, operation *GqlOperationType, credentialData []CredentialsPairType) (*authResponse, error) {
+	return h.executeResolved(credentialData, func(resolved []CredentialsPairType) (*authResponse, error) {
+		return h.sendGraphQLRequest(ctx, operation, resolved)
+	})
+}
+
+// sendGraphQLRequest sends a single GraphQL authentication operation
+func (h *AuthHandler) sendGraphQLRequest(ctx context.Context, operation *GqlOperationType, credentialData []CredentialsPairType) (*authResponse, error) {
 	// Build the GraphQL request
-	query, variables, err := BuildGraphQLRequest(operation, credentials.CredentialData)
+	query, variables, err := BuildGraphQLRequest(operation, credentialData)
 	if err != nil {
-		return "", fmt.Errorf("failed to build GraphQL request: %w", err)
+		return nil, fmt.Errorf("failed to build GraphQL request: %w", err)
 	}
 
 	// Create request body
@@ -191,46 +476,42 @@ func (h *AuthHandler) callGraphQLAuthEndpoint(operation *GqlOperationType, crede
 
 	reqData, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	// Determine the GraphQL endpoint URL
-	// For now, we'll use a placeholder - this should be configured
-	graphqlURL := "" // TODO: Get from endpoint configuration
+	// The operation is sent to the GraphQL endpoint configured on it
+	if operation.Url == "" {
+		return nil, fmt.Errorf("GraphQL operation %s has no url", operation.Name)
+	}
 
 	// Create HTTP request
-	req, err := http.NewRequest("POST", graphqlURL, bytes.NewBuffer(reqData))
+	req, err := http.NewRequestWithContext(ctx, "POST", operation.Url, bytes.NewBuffer(reqData))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	InjectTraceparent(ctx, req.Header)
 
 	// Execute request
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to execute request: %w", err)
+		return nil, &AuthEndpointUnavailableError{Err: fmt.Errorf("failed to execute request: %w", err)}
 	}
 	defer resp.Body.Close()
 
 	// Read response
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
+		return nil, &AuthEndpointUnavailableError{Err: fmt.Errorf("failed to read response: %w", err)}
 	}
 
 	// Check status code
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("GraphQL endpoint returned status %d: %s", resp.StatusCode, string(respBody))
+		return nil, classifyStatusError(&endpointStatusError{Endpoint: "GraphQL endpoint", StatusCode: resp.StatusCode})
 	}
 
-	// Extract token from response
-	token, err := ExtractTokenFromResponse(respBody, credentials.TokenLocation)
-	if err != nil {
-		return "", fmt.Errorf("failed to extract token: %w", err)
-	}
-
-	return token, nil
+	return &authResponse{Body: respBody, Header: resp.Header, Cookies: resp.Cookies()}, nil
 }
 
 // handleAPITokenAuth returns the API key directly
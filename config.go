@@ -2,8 +2,11 @@ package traefik_token_injector
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -12,11 +15,247 @@ import (
 // Config represents the plugin configuration from Traefik
 type Config struct {
 	ServiceId string `json:"serviceId" yaml:"serviceId"`
+
+	// Operation allowlist enforcement
+	EnforceOperations bool   `json:"enforceOperations" yaml:"enforceOperations"` // Only forward requests matching the instance operations
+	DenyStatusCode    int    `json:"denyStatusCode" yaml:"denyStatusCode"`       // Status code returned for denied requests
+	DenyMessage       string `json:"denyMessage" yaml:"denyMessage"`             // Response body returned for denied requests
+
+	// Routing
+	RouteToRemote bool `json:"routeToRemote" yaml:"routeToRemote"` // Proxy requests to the instance remote_host/remote_path instead of the next handler
+
+	// Dynamic instance selection, used instead of serviceId
+	InstanceSelector *InstanceSelectorConfig `json:"instanceSelector,omitempty" yaml:"instanceSelector"`
+
+	// Instance lookup by search fields, used instead of serviceId
+	InstanceLookup *InstanceLookupConfig `json:"instanceLookup,omitempty" yaml:"instanceLookup"`
+
+	// Only serve the instance at this version_id, used to stage credential rollouts
+	PinVersionId string `json:"pinVersionId" yaml:"pinVersionId"`
+
+	// Status codes and problem types of failed requests, the defaults apply when nil
+	ErrorResponses *ErrorResponsesConfig `json:"errorResponses,omitempty" yaml:"errorResponses"`
+
+	// Handling of requests while the control plane or an authentication endpoint is unavailable, fails closed when nil
+	Degradation *DegradationConfig `json:"degradation,omitempty" yaml:"degradation"`
+
+	// Prefetch of the instance and its first token when the middleware is created, disabled when nil
+	Warmup *WarmupConfig `json:"warmup,omitempty" yaml:"warmup"`
+}
+
+// WarmupConfig configures the warmup of a middleware
+type WarmupConfig struct {
+	Mode    string `json:"mode" yaml:"mode"`       // background or blocking (default: background)
+	Timeout string `json:"timeout" yaml:"timeout"` // Upper bound of the warmup (default: "10s")
+}
+
+// GetMode returns the warmup mode
+func (c *WarmupConfig) GetMode() string {
+	if c.Mode == "" {
+		return WarmupBackground
+	}
+	return c.Mode
+}
+
+// GetTimeout parses the warmup timeout string and returns a time.Duration
+func (c *WarmupConfig) GetTimeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return 10 * time.Second, nil
+	}
+	return time.ParseDuration(c.Timeout)
+}
+
+// Validate validates the warmup configuration
+func (c *WarmupConfig) Validate() error {
+	switch c.GetMode() {
+	case WarmupBackground, WarmupBlocking:
+		// Valid
+	default:
+		return fmt.Errorf("invalid warmup.mode: %s (must be 'background' or 'blocking')", c.Mode)
+	}
+	if timeout, err := c.GetTimeout(); err != nil || timeout <= 0 {
+		return fmt.Errorf("invalid warmup.timeout: %s", c.Timeout)
+	}
+	return nil
+}
+
+// DegradationConfig configures how requests are served while the control plane or an authentication endpoint is unavailable
+type DegradationConfig struct {
+	Policy      string `json:"policy" yaml:"policy"`           // failClosed, serveStale or passThrough (default: failClosed)
+	StaleMaxAge string `json:"staleMaxAge" yaml:"staleMaxAge"` // How long after the last successful request its instance and token are used (default: "5m")
+}
+
+// GetPolicy returns the degradation policy
+func (c *DegradationConfig) GetPolicy() string {
+	if c == nil || c.Policy == "" {
+		return DegradationFailClosed
+	}
+	return c.Policy
+}
+
+// GetStaleMaxAge parses the stale max age string and returns a time.Duration
+func (c *DegradationConfig) GetStaleMaxAge() (time.Duration, error) {
+	if c == nil || c.StaleMaxAge == "" {
+		return 5 * time.Minute, nil
+	}
+	return time.ParseDuration(c.StaleMaxAge)
+}
+
+// Validate validates the degradation configuration
+func (c *DegradationConfig) Validate() error {
+	switch c.GetPolicy() {
+	case DegradationFailClosed, DegradationServeStale, DegradationPassThrough:
+		// Valid
+	default:
+		return fmt.Errorf("invalid degradation.policy: %s (must be 'failClosed', 'serveStale' or 'passThrough')", c.Policy)
+	}
+	if maxAge, err := c.GetStaleMaxAge(); err != nil || maxAge <= 0 {
+		return fmt.Errorf("invalid degradation.staleMaxAge: %s", c.StaleMaxAge)
+	}
+	return nil
+}
+
+// ErrorResponsesConfig configures the application/problem+json responses of failed requests
+type ErrorResponsesConfig struct {
+	InstanceNotFound        int    `json:"instanceNotFound" yaml:"instanceNotFound"`               // Status code when the instance does not exist (default: 502)
+	ControlPlaneUnavailable int    `json:"controlPlaneUnavailable" yaml:"controlPlaneUnavailable"` // Status code when the GraphQL API fails (default: 503)
+	CredentialsRejected     int    `json:"credentialsRejected" yaml:"credentialsRejected"`         // Status code when the auth endpoint rejects the credentials (default: 401)
+	AuthEndpointUnavailable int    `json:"authEndpointUnavailable" yaml:"authEndpointUnavailable"` // Status code when the auth endpoint fails (default: 503)
+	TokenExtractionFailed   int    `json:"tokenExtractionFailed" yaml:"tokenExtractionFailed"`     // Status code when no token is found in the response (default: 502)
+	Timeout                 int    `json:"timeout" yaml:"timeout"`                                 // Status code when the GraphQL API or auth endpoint times out (default: 504)
+	InvalidHeaders          int    `json:"invalidHeaders" yaml:"invalidHeaders"`                   // Status code when the instance headers are invalid (default: 500)
+	TypeBase                string `json:"typeBase" yaml:"typeBase"`                               // Prefix of the problem type URIs (default: "urn:token-injector:problem:")
+	CorrelationIdHeader     string `json:"correlationIdHeader" yaml:"correlationIdHeader"`         // Header carrying the correlation ID (default: X-Request-Id)
+}
+
+// defaultProblemStatusCodes are the status codes of the problem types unless configured
+var defaultProblemStatusCodes = map[string]int{
+	ProblemInstanceNotFound:        http.StatusBadGateway,
+	ProblemControlPlaneUnavailable: http.StatusServiceUnavailable,
+	ProblemCredentialsRejected:     http.StatusUnauthorized,
+	ProblemAuthEndpointUnavailable: http.StatusServiceUnavailable,
+	ProblemTokenExtractionFailed:   http.StatusBadGateway,
+	ProblemTimeout:                 http.StatusGatewayTimeout,
+	ProblemInvalidHeaders:          http.StatusInternalServerError,
+	ProblemInternal:                http.StatusInternalServerError,
+}
+
+// statusCodes returns the configured status codes keyed by problem type, 0 when not configured
+func (c *ErrorResponsesConfig) statusCodes() map[string]int {
+	return map[string]int{
+		ProblemInstanceNotFound:        c.InstanceNotFound,
+		ProblemControlPlaneUnavailable: c.ControlPlaneUnavailable,
+		ProblemCredentialsRejected:     c.CredentialsRejected,
+		ProblemAuthEndpointUnavailable: c.AuthEndpointUnavailable,
+		ProblemTokenExtractionFailed:   c.TokenExtractionFailed,
+		ProblemTimeout:                 c.Timeout,
+		ProblemInvalidHeaders:          c.InvalidHeaders,
+	}
+}
+
+// GetStatusCode returns the status code of a problem type
+func (c *ErrorResponsesConfig) GetStatusCode(problemType string) int {
+	if c != nil {
+		if statusCode := c.statusCodes()[problemType]; statusCode != 0 {
+			return statusCode
+		}
+	}
+	return defaultProblemStatusCodes[problemType]
+}
+
+// GetTypeBase returns the prefix of the problem type URIs
+func (c *ErrorResponsesConfig) GetTypeBase() string {
+	if c == nil || c.TypeBase == "" {
+		return "urn:token-injector:problem:"
+	}
+	return c.TypeBase
+}
+
+// GetCorrelationIdHeader returns the header carrying the correlation ID
+func (c *ErrorResponsesConfig) GetCorrelationIdHeader() string {
+	if c == nil || c.CorrelationIdHeader == "" {
+		return "X-Request-Id"
+	}
+	return c.CorrelationIdHeader
+}
+
+// Validate validates the error responses configuration
+func (c *ErrorResponsesConfig) Validate() error {
+	for problemType, statusCode := range c.statusCodes() {
+		if statusCode != 0 && (statusCode < 400 || statusCode > 599) {
+			return fmt.Errorf("errorResponses status code of %s must be a 4xx or 5xx status code", problemType)
+		}
+	}
+	return nil
+}
+
+// PinConditions returns the search conditions restricting lookups to the pinned version_id
+func (c *Config) PinConditions() []SearchCondition {
+	if c.PinVersionId == "" {
+		return nil
+	}
+	return []SearchCondition{{Field: "version_id", Value: c.PinVersionId, Kind: "ID", Operator: "EQ"}}
+}
+
+// InstanceLookupConfig configures a search for the instance served by the middleware
+// All given fields must match, and the search must match exactly one instance
+type InstanceLookupConfig struct {
+	Name      string            `json:"name" yaml:"name"`
+	Type      string            `json:"type" yaml:"type"`
+	VersionId string            `json:"versionId" yaml:"versionId"`
+	Search    []SearchCondition `json:"search" yaml:"search"` // Any field/operator/kind combination supported by getInstances
+}
+
+// Conditions returns the getInstances search conditions of the lookup
+func (c *InstanceLookupConfig) Conditions() []SearchCondition {
+	var conditions []SearchCondition
+	if c.Name != "" {
+		conditions = append(conditions, SearchCondition{Field: "name", Value: c.Name, Kind: "STRING", Operator: "EQ"})
+	}
+	if c.Type != "" {
+		conditions = append(conditions, SearchCondition{Field: "type", Value: c.Type, Kind: "STRING", Operator: "EQ"})
+	}
+	if c.VersionId != "" {
+		conditions = append(conditions, SearchCondition{Field: "version_id", Value: c.VersionId, Kind: "ID", Operator: "EQ"})
+	}
+	return append(conditions, c.Search...)
+}
+
+// Validate validates the instance lookup configuration
+func (c *InstanceLookupConfig) Validate() error {
+	conditions := c.Conditions()
+	if len(conditions) == 0 {
+		return fmt.Errorf("instanceLookup requires at least one search field")
+	}
+	for _, condition := range conditions {
+		if condition.Field == "" {
+			return fmt.Errorf("instanceLookup.search field is required")
+		}
+		if _, _, err := searchEnums(condition); err != nil {
+			return fmt.Errorf("invalid instanceLookup.search: %w", err)
+		}
+	}
+	return nil
+}
+
+// InstanceSelectorConfig configures how the instance is selected for each request
+type InstanceSelectorConfig struct {
+	Source            string `json:"source" yaml:"source"`                       // header, path, subdomain, match
+	Header            string `json:"header" yaml:"header"`                       // Header carrying the instance ID (default: X-Service-Id)
+	PathSegment       int    `json:"pathSegment" yaml:"pathSegment"`             // 1-based path segment carrying the instance ID (default: 1)
+	Domain            string `json:"domain" yaml:"domain"`                       // Parent domain for subdomain selection, e.g. "api.example.com"
+	CacheSize         int    `json:"cacheSize" yaml:"cacheSize"`                 // Maximum number of cached lookups (default: 1000)
+	CacheTtl          string `json:"cacheTtl" yaml:"cacheTtl"`                   // How long lookups are cached (default: "30s")
+	NoMatchStatusCode int    `json:"noMatchStatusCode" yaml:"noMatchStatusCode"` // Status code when no instance matches (default: 404)
+	NoMatchMessage    string `json:"noMatchMessage" yaml:"noMatchMessage"`       // Response body when no instance matches
 }
 
 // CreateConfig creates the default plugin config
 func CreateConfig() *Config {
-	return &Config{}
+	return &Config{
+		DenyStatusCode: http.StatusForbidden,
+		DenyMessage:    "Operation not allowed",
+	}
 }
 
 // GlobalConfig represents the global configuration from config.yml
@@ -30,6 +269,238 @@ type GlobalConfig struct {
 	Timeout            string `yaml:"timeout"`
 	CacheEnabled       bool   `yaml:"cache_enabled"`
 	TokenRefreshBuffer int    `yaml:"token_refresh_buffer"`
+
+	// Token cache bounds
+	CacheMaxEntries      int    `yaml:"cache_max_entries"`      // Maximum number of cached tokens, least recently used tokens are evicted
+	CacheJanitorInterval string `yaml:"cache_janitor_interval"` // How often expired tokens are removed
+
+	// Encrypted on-disk token cache settings
+	CacheDir     string `yaml:"cache_dir"`      // Directory of the encrypted token files, persistence is disabled when empty
+	CacheKeyEnv  string `yaml:"cache_key_env"`  // Environment variable holding the base64 encoded AES-256 key
+	CacheKeyFile string `yaml:"cache_key_file"` // File holding the base64 encoded AES-256 key, takes precedence over cache_key_env
+
+	// Shared token store settings
+	TokenStore        string `yaml:"token_store"`          // "" (local only) or "redis"
+	TokenStoreLockTtl string `yaml:"token_store_lock_ttl"` // How long a replica may hold the refresh lock of a token
+	RedisAddress      string `yaml:"redis_address"`        // host:port of the Redis-protocol server
+	RedisUsername     string `yaml:"redis_username"`
+	RedisPassword     string `yaml:"redis_password"`
+	RedisDB           int    `yaml:"redis_db"`
+	RedisKeyPrefix    string `yaml:"redis_key_prefix"` // Prefix of the keys of tokens and refresh locks
+
+	// Write-back of obtained tokens to the control plane, disabled when nil
+	TokenWriteBack *TokenWriteBackConfig `yaml:"token_write_back"`
+
+	// Admin API settings, disabled when nil
+	Admin *AdminConfig `yaml:"admin"`
+
+	// Tracing settings, disabled when nil
+	Tracing *TracingConfig `yaml:"tracing"`
+
+	// Logging settings
+	Logging *LoggingConfig `yaml:"logging"`
+
+	// Environment variables readable by the env template function, a trailing * matches a prefix
+	TemplateEnv []string `yaml:"template_env"`
+
+	// Authentication endpoint fallback settings
+	EndpointFailureThreshold *int   `yaml:"endpoint_failure_threshold"` // Consecutive failures before an endpoint is demoted, 0 disables demotion
+	EndpointDemotion         string `yaml:"endpoint_demotion"`          // How long a failing endpoint stays demoted
+
+	// Bulk instance sync settings
+	SyncEnabled      bool   `yaml:"sync_enabled"`       // Keep a shared in-memory index of all instances
+	SyncInterval     string `yaml:"sync_interval"`      // How often changed instances are fetched
+	SyncFullInterval string `yaml:"sync_full_interval"` // How often the whole index is rebuilt, dropping deleted instances
+
+	// Pagination settings for instance and endpoint connections
+	PageSize int `yaml:"page_size"` // Number of items fetched per page
+	MaxPages int `yaml:"max_pages"` // Upper bound on the number of pages fetched per connection
+}
+
+// TokenWriteBackConfig configures the mutation storing obtained tokens on their instance
+type TokenWriteBackConfig struct {
+	Mutation  string            `yaml:"mutation"`   // Name of the mutation
+	Fields    map[string]string `yaml:"fields"`     // Mutation argument -> value (id, token, token_ttl, expires_at)
+	Selection string            `yaml:"selection"`  // Selection set of the mutation result, e.g. "_id" (none when empty)
+	QueueSize int               `yaml:"queue_size"` // Maximum number of pending write-backs (default: 100)
+
+	// GraphQL types of the mutation variables per value, e.g. {id: "String!"}
+	// Defaults: id "ID!", token "String!", token_ttl "Int", expires_at "Int"
+	VariableTypes map[string]string `yaml:"variable_types"`
+
+	// Credentials field the control plane returns the written-back expiry in, as a Unix timestamp
+	// Without it the age of a token provided by the control plane is unknown and the token is not used
+	ExpiresAtField string `yaml:"expires_at_field"`
+
+	// Field of the mutation result holding the instance updated_at after the write-back (default: "updated_at")
+	// The change is recorded so the write-back does not invalidate the token it stored
+	UpdatedAtField string `yaml:"updated_at_field"`
+}
+
+// writeBackValues are the values that can be mapped to mutation arguments
+var writeBackValues = map[string]bool{
+	"id":         true, // Instance ID
+	"token":      true, // Obtained token
+	"token_ttl":  true, // Token TTL in seconds, null without TTL
+	"expires_at": true, // Unix timestamp the token expires at, null without TTL
+}
+
+// defaultWriteBackVariableTypes are the GraphQL types of the mutation variables unless variable_types overrides them
+var defaultWriteBackVariableTypes = map[string]string{
+	"id":         "ID!",
+	"token":      "String!",
+	"token_ttl":  "Int",
+	"expires_at": "Int",
+}
+
+// graphQLTypePattern matches a named or list GraphQL input type, optionally non-null
+var graphQLTypePattern = regexp.MustCompile(`^(\[[_A-Za-z][_0-9A-Za-z]*!?\]|[_A-Za-z][_0-9A-Za-z]*)!?$`)
+
+// GetVariableType returns the GraphQL type of the variable of a write-back value
+func (c *TokenWriteBackConfig) GetVariableType(value string) string {
+	if variableType, ok := c.VariableTypes[value]; ok {
+		return variableType
+	}
+	return defaultWriteBackVariableTypes[value]
+}
+
+// Validate checks the write-back configuration
+func (c *TokenWriteBackConfig) Validate() error {
+	if !isGraphQLName(c.Mutation) {
+		return fmt.Errorf("token_write_back.mutation is not a valid GraphQL name: %q", c.Mutation)
+	}
+	if len(c.Fields) == 0 {
+		return fmt.Errorf("token_write_back.fields requires at least one field")
+	}
+
+	hasToken := false
+	for argument, value := range c.Fields {
+		if !isGraphQLName(argument) {
+			return fmt.Errorf("token_write_back.fields argument is not a valid GraphQL name: %q", argument)
+		}
+		if !writeBackValues[value] {
+			return fmt.Errorf("token_write_back.fields.%s has unknown value %q (must be id, token, token_ttl or expires_at)", argument, value)
+		}
+		hasToken = hasToken || value == "token"
+	}
+	if !hasToken {
+		return fmt.Errorf("token_write_back.fields must map the token")
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("token_write_back.queue_size must not be negative")
+	}
+	for value, variableType := range c.VariableTypes {
+		if !writeBackValues[value] {
+			return fmt.Errorf("token_write_back.variable_types has unknown value %q (must be id, token, token_ttl or expires_at)", value)
+		}
+		if !graphQLTypePattern.MatchString(variableType) {
+			return fmt.Errorf("token_write_back.variable_types.%s is not a valid GraphQL type: %q", value, variableType)
+		}
+	}
+	if c.ExpiresAtField != "" && !isGraphQLName(c.ExpiresAtField) {
+		return fmt.Errorf("token_write_back.expires_at_field is not a valid GraphQL name: %q", c.ExpiresAtField)
+	}
+	if c.UpdatedAtField != "" && !isGraphQLName(c.UpdatedAtField) {
+		return fmt.Errorf("token_write_back.updated_at_field is not a valid GraphQL name: %q", c.UpdatedAtField)
+	}
+	return nil
+}
+
+// AdminConfig configures the admin API
+type AdminConfig struct {
+	Listen     string `yaml:"listen"`      // Address of a separate admin listener; when empty the API is served by the middlewares
+	PathPrefix string `yaml:"path_prefix"` // Path the admin API is served under (default: "/_token_injector")
+	Token      string `yaml:"token"`       // Bearer token required by the admin API
+	TokenEnv   string `yaml:"token_env"`   // Environment variable holding the token, used when token is empty
+}
+
+// GetToken returns the admin token from the configuration or the environment
+func (c *AdminConfig) GetToken() string {
+	if c.Token != "" {
+		return c.Token
+	}
+	if c.TokenEnv != "" {
+		return os.Getenv(c.TokenEnv)
+	}
+	return ""
+}
+
+// Validate checks the admin configuration
+func (c *AdminConfig) Validate() error {
+	if c.GetToken() == "" {
+		return fmt.Errorf("admin requires a token (admin.token or admin.token_env)")
+	}
+	if !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("admin.path_prefix must start with /: %s", c.PathPrefix)
+	}
+	return nil
+}
+
+// TracingConfig configures the export of spans to an OTLP/HTTP collector
+type TracingConfig struct {
+	Endpoint      string            `yaml:"endpoint"`       // OTLP/HTTP traces URL, e.g. "http://collector:4318/v1/traces"
+	ServiceName   string            `yaml:"service_name"`   // service.name resource attribute (default: "traefik-token-injector")
+	Headers       map[string]string `yaml:"headers"`        // Headers sent to the collector, e.g. for authentication
+	BatchSize     int               `yaml:"batch_size"`     // Spans sent per export request (default: 100)
+	QueueSize     int               `yaml:"queue_size"`     // Finished spans waiting for export, further spans are dropped (default: 2048)
+	FlushInterval string            `yaml:"flush_interval"` // How often pending spans are exported (default: "5s")
+}
+
+// GetFlushInterval parses the flush interval string and returns a time.Duration
+func (c *TracingConfig) GetFlushInterval() (time.Duration, error) {
+	return time.ParseDuration(c.FlushInterval)
+}
+
+// Validate checks the tracing configuration
+func (c *TracingConfig) Validate() error {
+	if !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+		return fmt.Errorf("tracing.endpoint must be an http(s) URL: %q", c.Endpoint)
+	}
+	if c.BatchSize < 0 || c.QueueSize < 0 {
+		return fmt.Errorf("tracing.batch_size and tracing.queue_size must not be negative")
+	}
+	if interval, err := c.GetFlushInterval(); err != nil || interval <= 0 {
+		return fmt.Errorf("invalid tracing.flush_interval: %s", c.FlushInterval)
+	}
+	return nil
+}
+
+// LoggingConfig configures the log output
+type LoggingConfig struct {
+	Level    string             `yaml:"level"`    // debug, info, warn or error (default: "info")
+	Format   string             `yaml:"format"`   // text or json (default: "text")
+	Sampling *LogSamplingConfig `yaml:"sampling"` // Sampling of debug and info messages, disabled when nil
+}
+
+// LogSamplingConfig limits how often the same debug or info message is logged
+type LogSamplingConfig struct {
+	Initial    int    `yaml:"initial"`    // Messages logged per interval before sampling starts (default: 10)
+	Thereafter int    `yaml:"thereafter"` // Then every nth message is logged, none when 0 (default: 100)
+	Interval   string `yaml:"interval"`   // Length of a sampling interval (default: "1s")
+}
+
+// GetInterval parses the sampling interval string and returns a time.Duration
+func (c *LogSamplingConfig) GetInterval() (time.Duration, error) {
+	return time.ParseDuration(c.Interval)
+}
+
+// Validate checks the logging configuration
+func (c *LoggingConfig) Validate() error {
+	if _, ok := logLevelNames[c.Level]; !ok {
+		return fmt.Errorf("invalid logging.level: %s (must be debug, info, warn or error)", c.Level)
+	}
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("invalid logging.format: %s (must be text or json)", c.Format)
+	}
+	if c.Sampling != nil {
+		if c.Sampling.Initial <= 0 || c.Sampling.Thereafter < 0 {
+			return fmt.Errorf("logging.sampling.initial must be positive and logging.sampling.thereafter must not be negative")
+		}
+		if interval, err := c.Sampling.GetInterval(); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid logging.sampling.interval: %s", c.Sampling.Interval)
+		}
+	}
+	return nil
 }
 
 // LoadGlobalConfig loads the global configuration from instance/etc/config.yml
@@ -68,6 +539,86 @@ func LoadGlobalConfig() (*GlobalConfig, error) {
 	if config.TokenRefreshBuffer == 0 {
 		config.TokenRefreshBuffer = 10
 	}
+	if config.CacheMaxEntries == 0 {
+		config.CacheMaxEntries = 10000
+	}
+	if config.CacheJanitorInterval == "" {
+		config.CacheJanitorInterval = "1m"
+	}
+	if config.CacheKeyEnv == "" {
+		config.CacheKeyEnv = "TOKEN_CACHE_KEY"
+	}
+	if config.TokenStoreLockTtl == "" {
+		config.TokenStoreLockTtl = "10s"
+	}
+	if config.RedisKeyPrefix == "" {
+		config.RedisKeyPrefix = "token-injector:"
+	}
+	if config.TokenWriteBack != nil {
+		if config.TokenWriteBack.QueueSize == 0 {
+			config.TokenWriteBack.QueueSize = 100
+		}
+		if config.TokenWriteBack.UpdatedAtField == "" {
+			config.TokenWriteBack.UpdatedAtField = "updated_at"
+		}
+	}
+	if config.Admin != nil && config.Admin.PathPrefix == "" {
+		config.Admin.PathPrefix = "/_token_injector"
+	}
+	if config.Tracing != nil {
+		if config.Tracing.ServiceName == "" {
+			config.Tracing.ServiceName = "traefik-token-injector"
+		}
+		if config.Tracing.BatchSize == 0 {
+			config.Tracing.BatchSize = 100
+		}
+		if config.Tracing.QueueSize == 0 {
+			config.Tracing.QueueSize = 2048
+		}
+		if config.Tracing.FlushInterval == "" {
+			config.Tracing.FlushInterval = "5s"
+		}
+	}
+	if config.Logging == nil {
+		config.Logging = &LoggingConfig{}
+	}
+	if config.Logging.Level == "" {
+		config.Logging.Level = "info"
+	}
+	if config.Logging.Format == "" {
+		config.Logging.Format = "text"
+	}
+	if sampling := config.Logging.Sampling; sampling != nil {
+		if sampling.Initial == 0 {
+			sampling.Initial = 10
+		}
+		if sampling.Thereafter == 0 {
+			sampling.Thereafter = 100
+		}
+		if sampling.Interval == "" {
+			sampling.Interval = "1s"
+		}
+	}
+	// An explicit 0 disables demotion, so the default only applies when the field is unset
+	if config.EndpointFailureThreshold == nil {
+		threshold := 3
+		config.EndpointFailureThreshold = &threshold
+	}
+	if config.EndpointDemotion == "" {
+		config.EndpointDemotion = "30s"
+	}
+	if config.SyncInterval == "" {
+		config.SyncInterval = "30s"
+	}
+	if config.SyncFullInterval == "" {
+		config.SyncFullInterval = "10m"
+	}
+	if config.PageSize == 0 {
+		config.PageSize = 100
+	}
+	if config.MaxPages == 0 {
+		config.MaxPages = 100
+	}
 
 	return &config, nil
 }
@@ -77,10 +628,158 @@ func (c *GlobalConfig) GetTimeout() (time.Duration, error) {
 	return time.ParseDuration(c.Timeout)
 }
 
+// GetCacheJanitorInterval parses the cache janitor interval string and returns a time.Duration
+func (c *GlobalConfig) GetCacheJanitorInterval() (time.Duration, error) {
+	return time.ParseDuration(c.CacheJanitorInterval)
+}
+
+// GetTokenStoreLockTtl parses the refresh lock TTL string and returns a time.Duration
+func (c *GlobalConfig) GetTokenStoreLockTtl() (time.Duration, error) {
+	return time.ParseDuration(c.TokenStoreLockTtl)
+}
+
+// GetEndpointFailureThreshold returns the consecutive failures before an endpoint is demoted, 0 when unset
+func (c *GlobalConfig) GetEndpointFailureThreshold() int {
+	if c.EndpointFailureThreshold == nil {
+		return 0
+	}
+	return *c.EndpointFailureThreshold
+}
+
+// GetEndpointDemotion parses the endpoint demotion string and returns a time.Duration
+func (c *GlobalConfig) GetEndpointDemotion() (time.Duration, error) {
+	return time.ParseDuration(c.EndpointDemotion)
+}
+
+// GetHeader returns the header carrying the instance ID
+func (c *InstanceSelectorConfig) GetHeader() string {
+	if c.Header == "" {
+		return "X-Service-Id"
+	}
+	return c.Header
+}
+
+// GetPathSegment returns the 1-based path segment carrying the instance ID
+func (c *InstanceSelectorConfig) GetPathSegment() int {
+	if c.PathSegment <= 0 {
+		return 1
+	}
+	return c.PathSegment
+}
+
+// GetCacheSize returns the maximum number of cached instance lookups
+func (c *InstanceSelectorConfig) GetCacheSize() int {
+	if c.CacheSize <= 0 {
+		return 1000
+	}
+	return c.CacheSize
+}
+
+// GetCacheTtl parses the cache TTL string and returns a time.Duration
+func (c *InstanceSelectorConfig) GetCacheTtl() (time.Duration, error) {
+	if c.CacheTtl == "" {
+		return 30 * time.Second, nil
+	}
+	return time.ParseDuration(c.CacheTtl)
+}
+
+// GetNoMatchStatusCode returns the status code used when no instance matches
+func (c *InstanceSelectorConfig) GetNoMatchStatusCode() int {
+	if c.NoMatchStatusCode == 0 {
+		return http.StatusNotFound
+	}
+	return c.NoMatchStatusCode
+}
+
+// GetNoMatchMessage returns the response body used when no instance matches
+func (c *InstanceSelectorConfig) GetNoMatchMessage() string {
+	if c.NoMatchMessage == "" {
+		return "No instance matches the request"
+	}
+	return c.NoMatchMessage
+}
+
+// Validate validates the instance selector configuration
+func (c *InstanceSelectorConfig) Validate() error {
+	switch c.Source {
+	case SelectorSourceHeader, SelectorSourcePath, SelectorSourceSubdomain, SelectorSourceMatch:
+		// Valid
+	default:
+		return fmt.Errorf("invalid instanceSelector.source: %s (must be 'header', 'path', 'subdomain' or 'match')", c.Source)
+	}
+	if _, err := c.GetCacheTtl(); err != nil {
+		return fmt.Errorf("invalid instanceSelector.cacheTtl: %w", err)
+	}
+	if code := c.GetNoMatchStatusCode(); code < 400 || code > 599 {
+		return fmt.Errorf("instanceSelector.noMatchStatusCode must be a 4xx or 5xx status code")
+	}
+	return nil
+}
+
+// GetSyncInterval parses the sync interval string and returns a time.Duration
+func (c *GlobalConfig) GetSyncInterval() (time.Duration, error) {
+	return time.ParseDuration(c.SyncInterval)
+}
+
+// GetSyncFullInterval parses the full sync interval string and returns a time.Duration
+func (c *GlobalConfig) GetSyncFullInterval() (time.Duration, error) {
+	return time.ParseDuration(c.SyncFullInterval)
+}
+
 // Validate validates the configuration
 func (c *Config) Validate() error {
-	if c.ServiceId == "" {
-		return fmt.Errorf("serviceId is required")
+	// Exactly one way of determining the instance must be configured
+	sources := 0
+	if c.ServiceId != "" {
+		sources++
+	}
+	if c.InstanceSelector != nil {
+		sources++
+	}
+	if c.InstanceLookup != nil {
+		sources++
+	}
+	if sources == 0 {
+		return fmt.Errorf("serviceId, instanceSelector or instanceLookup is required")
+	}
+	if sources > 1 {
+		return fmt.Errorf("serviceId, instanceSelector and instanceLookup are mutually exclusive")
+	}
+
+	if c.InstanceSelector != nil {
+		if err := c.InstanceSelector.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.InstanceLookup != nil {
+		if err := c.InstanceLookup.Validate(); err != nil {
+			return err
+		}
+		if c.PinVersionId != "" && c.InstanceLookup.VersionId != "" && c.PinVersionId != c.InstanceLookup.VersionId {
+			return fmt.Errorf("pinVersionId conflicts with instanceLookup.versionId")
+		}
+	}
+	if c.DenyStatusCode != 0 && (c.DenyStatusCode < 400 || c.DenyStatusCode > 599) {
+		return fmt.Errorf("denyStatusCode must be a 4xx or 5xx status code")
+	}
+	if c.ErrorResponses != nil {
+		if err := c.ErrorResponses.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Degradation != nil {
+		if err := c.Degradation.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.Warmup != nil {
+		// A selector middleware has no instance until requests arrive
+		if c.InstanceSelector != nil {
+			return fmt.Errorf("warmup requires serviceId or instanceLookup")
+		}
+		if err := c.Warmup.Validate(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -113,5 +812,101 @@ func (c *GlobalConfig) Validate() error {
 		}
 	}
 
+	// Validate cache settings
+	if c.CacheMaxEntries < 0 {
+		return fmt.Errorf("cache_max_entries must not be negative")
+	}
+	if interval, err := c.GetCacheJanitorInterval(); err != nil || interval <= 0 {
+		return fmt.Errorf("invalid cache_janitor_interval: %s", c.CacheJanitorInterval)
+	}
+	// The token file and the shared token store are encrypted with the cache key
+	if c.CacheDir != "" || c.TokenStore == "redis" {
+		key, err := LoadCacheKey(c)
+		if err != nil {
+			return fmt.Errorf("invalid cache key: %w", err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("cache key must be 32 bytes, got %d", len(key))
+		}
+	}
+
+	// Validate shared token store settings
+	switch c.TokenStore {
+	case "":
+	case "redis":
+		if c.RedisAddress == "" {
+			return fmt.Errorf("redis_address is required when token_store is redis")
+		}
+		if c.RedisDB < 0 {
+			return fmt.Errorf("redis_db must not be negative")
+		}
+	default:
+		return fmt.Errorf("invalid token_store: %s (must be empty or redis)", c.TokenStore)
+	}
+	if ttl, err := c.GetTokenStoreLockTtl(); err != nil || ttl <= 0 {
+		return fmt.Errorf("invalid token_store_lock_ttl: %s", c.TokenStoreLockTtl)
+	}
+
+	// Validate token write-back settings
+	if c.TokenWriteBack != nil {
+		if err := c.TokenWriteBack.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate admin API settings
+	if c.Admin != nil {
+		if err := c.Admin.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate tracing settings
+	if c.Tracing != nil {
+		if err := c.Tracing.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate logging settings
+	if c.Logging != nil {
+		if err := c.Logging.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate template settings
+	for _, name := range c.TemplateEnv {
+		if strings.TrimSuffix(name, "*") == "" {
+			return fmt.Errorf("template_env entries must name a variable or a non-empty prefix")
+		}
+	}
+
+	// Validate endpoint fallback settings
+	if c.GetEndpointFailureThreshold() < 0 {
+		return fmt.Errorf("endpoint_failure_threshold must not be negative")
+	}
+	if _, err := c.GetEndpointDemotion(); err != nil {
+		return fmt.Errorf("invalid endpoint_demotion: %w", err)
+	}
+
+	// Validate sync settings
+	if c.SyncEnabled {
+		if interval, err := c.GetSyncInterval(); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid sync_interval: %s", c.SyncInterval)
+		}
+		if interval, err := c.GetSyncFullInterval(); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid sync_full_interval: %s", c.SyncFullInterval)
+		}
+	}
+
+	// Validate pagination settings
+	if c.PageSize < 0 {
+		return fmt.Errorf("page_size must not be negative")
+	}
+	if c.MaxPages < 0 {
+		return fmt.Errorf("max_pages must not be negative")
+	}
+
 	return nil
 }
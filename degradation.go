@@ -0,0 +1,65 @@
+package traefik_token_injector
+
+import (
+	"sync"
+	"time"
+)
+
+// Degradation policies applied when the control plane or an authentication endpoint is unavailable
+const (
+	DegradationFailClosed  = "failClosed"  // Fail the request
+	DegradationServeStale  = "serveStale"  // Forward with the token of the last successful request
+	DegradationPassThrough = "passThrough" // Forward without credentials
+)
+
+// degradable reports whether a failure of the given problem type is handled by the degradation policy
+// Only outages qualify: rejected credentials or missing instances fail the request under every policy
+func degradable(problemType string) bool {
+	switch problemType {
+	case ProblemControlPlaneUnavailable, ProblemAuthEndpointUnavailable, ProblemTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// staleToken is the instance and token of the last successful request of a service
+type staleToken struct {
+	instance   *InstanceType
+	token      string
+	recordedAt time.Time
+}
+
+// StaleTokens keeps the last known good instance and token of each service for the serveStale policy
+type StaleTokens struct {
+	mu      sync.Mutex
+	entries map[string]staleToken
+}
+
+// NewStaleTokens creates an empty store
+func NewStaleTokens() *StaleTokens {
+	return &StaleTokens{entries: make(map[string]staleToken)}
+}
+
+// Record stores the instance and token of a successful request
+func (s *StaleTokens) Record(key string, instance *InstanceType, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = staleToken{instance: instance, token: token, recordedAt: time.Now()}
+}
+
+// Get returns the last known good instance and token if they were recorded within maxAge
+func (s *StaleTokens) Get(key string, maxAge time.Duration) (staleToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return staleToken{}, false
+	}
+	if time.Since(entry.recordedAt) > maxAge {
+		delete(s.entries, key)
+		return staleToken{}, false
+	}
+	return entry, true
+}
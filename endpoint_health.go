@@ -0,0 +1,99 @@
+package traefik_token_injector
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EndpointHealth tracks consecutive failures of authentication endpoints and
+// temporarily demotes endpoints that keep failing
+type EndpointHealth struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointState
+	threshold int
+	demotion  time.Duration
+}
+
+// endpointState holds the health state of a single endpoint
+type endpointState struct {
+	failures     int
+	demotedUntil time.Time
+	lastError    string
+}
+
+// NewEndpointHealth creates a new endpoint health tracker
+// Endpoints are demoted for the given duration after threshold consecutive failures, a threshold of 0 never demotes
+func NewEndpointHealth(threshold int, demotion time.Duration) *EndpointHealth {
+	return &EndpointHealth{
+		endpoints: make(map[string]*endpointState),
+		threshold: threshold,
+		demotion:  demotion,
+	}
+}
+
+// Order returns the indexes of the given endpoint keys in the order they should be tried
+// Healthy endpoints keep their configured order, demoted endpoints are moved to the end
+// ordered by the time their demotion expires
+func (h *EndpointHealth) Order(keys []string) []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	healthy := make([]int, 0, len(keys))
+	demoted := make([]int, 0)
+
+	for i, key := range keys {
+		state, ok := h.endpoints[key]
+		if ok && state.demotedUntil.After(now) {
+			demoted = append(demoted, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+
+	sort.SliceStable(demoted, func(a, b int) bool {
+		return h.endpoints[keys[demoted[a]]].demotedUntil.Before(h.endpoints[keys[demoted[b]]].demotedUntil)
+	})
+
+	return append(healthy, demoted...)
+}
+
+// RecordSuccess resets the failure state of an endpoint
+func (h *EndpointHealth) RecordSuccess(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.endpoints, key)
+}
+
+// RecordFailure records a failed call to an endpoint and demotes it once the
+// failure threshold is reached
+func (h *EndpointHealth) RecordFailure(key string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, ok := h.endpoints[key]
+	if !ok {
+		state = &endpointState{}
+		h.endpoints[key] = state
+	}
+
+	state.failures++
+	if err != nil {
+		state.lastError = err.Error()
+	}
+
+	if h.threshold > 0 && state.failures >= h.threshold {
+		state.demotedUntil = time.Now().Add(h.demotion)
+	}
+}
+
+// IsDemoted reports whether an endpoint is currently demoted
+func (h *EndpointHealth) IsDemoted(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, ok := h.endpoints[key]
+	return ok && state.demotedUntil.After(time.Now())
+}
@@ -0,0 +1,176 @@
+package traefik_token_injector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// InstanceNotFoundError is returned when no instance matches the configured service or the request
+type InstanceNotFoundError struct {
+	Err error
+}
+
+func (e *InstanceNotFoundError) Error() string { return e.Err.Error() }
+func (e *InstanceNotFoundError) Unwrap() error { return e.Err }
+
+// ControlPlaneUnavailableError is returned when instance data cannot be fetched from the GraphQL API
+type ControlPlaneUnavailableError struct {
+	Err error
+}
+
+func (e *ControlPlaneUnavailableError) Error() string { return e.Err.Error() }
+func (e *ControlPlaneUnavailableError) Unwrap() error { return e.Err }
+
+// CredentialsRejectedError is returned when an authentication endpoint rejects the configured credentials
+type CredentialsRejectedError struct {
+	Err error
+}
+
+func (e *CredentialsRejectedError) Error() string { return e.Err.Error() }
+func (e *CredentialsRejectedError) Unwrap() error { return e.Err }
+
+// AuthEndpointUnavailableError is returned when an authentication endpoint cannot be reached or fails
+type AuthEndpointUnavailableError struct {
+	Err error
+}
+
+func (e *AuthEndpointUnavailableError) Error() string { return e.Err.Error() }
+func (e *AuthEndpointUnavailableError) Unwrap() error { return e.Err }
+
+// TokenExtractionError is returned when the token cannot be extracted from an authentication endpoint response
+type TokenExtractionError struct {
+	Err error
+}
+
+func (e *TokenExtractionError) Error() string { return e.Err.Error() }
+func (e *TokenExtractionError) Unwrap() error { return e.Err }
+
+// HeaderConfigurationError is returned when the instance headers are invalid or their templates cannot be evaluated
+type HeaderConfigurationError struct {
+	Err error
+}
+
+func (e *HeaderConfigurationError) Error() string { return e.Err.Error() }
+func (e *HeaderConfigurationError) Unwrap() error { return e.Err }
+
+// Problem types of the error responses, appended to the configured type base
+const (
+	ProblemInstanceNotFound        = "instance-not-found"
+	ProblemControlPlaneUnavailable = "control-plane-unavailable"
+	ProblemCredentialsRejected     = "credentials-rejected"
+	ProblemAuthEndpointUnavailable = "auth-endpoint-unavailable"
+	ProblemTokenExtractionFailed   = "token-extraction-failed"
+	ProblemTimeout                 = "timeout"
+	ProblemInvalidHeaders          = "invalid-headers"
+	ProblemInternal                = "internal-error"
+)
+
+// problemTitles are the short summaries of the problem types
+var problemTitles = map[string]string{
+	ProblemInstanceNotFound:        "Instance not found",
+	ProblemControlPlaneUnavailable: "Control plane unavailable",
+	ProblemCredentialsRejected:     "Credentials rejected",
+	ProblemAuthEndpointUnavailable: "Authentication endpoint unavailable",
+	ProblemTokenExtractionFailed:   "Token extraction failed",
+	ProblemTimeout:                 "Upstream timeout",
+	ProblemInvalidHeaders:          "Invalid header configuration",
+	ProblemInternal:                "Internal error",
+}
+
+// problemDetails explain the problem types to clients without revealing internals
+var problemDetails = map[string]string{
+	ProblemInstanceNotFound:        "No instance is configured for the requested service.",
+	ProblemControlPlaneUnavailable: "The instance configuration could not be fetched from the control plane.",
+	ProblemCredentialsRejected:     "The authentication endpoint rejected the credentials configured for the service.",
+	ProblemAuthEndpointUnavailable: "No token could be obtained because the authentication endpoint is unavailable.",
+	ProblemTokenExtractionFailed:   "The authentication endpoint response did not contain a token.",
+	ProblemTimeout:                 "The control plane or the authentication endpoint did not respond in time.",
+	ProblemInvalidHeaders:          "The headers configured for the service are invalid or could not be evaluated.",
+	ProblemInternal:                "The request could not be authenticated.",
+}
+
+// ProblemDetails is an RFC 9457 problem details response body
+type ProblemDetails struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail"`
+	CorrelationId string `json:"correlationId"`
+}
+
+// ClassifyError returns the problem type of an error of the request path
+// Credential problems take precedence when several authentication endpoints failed for different reasons
+func ClassifyError(err error) string {
+	var notFound *InstanceNotFoundError
+	var controlPlane *ControlPlaneUnavailableError
+	var rejected *CredentialsRejectedError
+	var extraction *TokenExtractionError
+	var authEndpoint *AuthEndpointUnavailableError
+	var headers *HeaderConfigurationError
+
+	switch {
+	case errors.As(err, &notFound):
+		return ProblemInstanceNotFound
+	case errors.As(err, &headers):
+		return ProblemInvalidHeaders
+	case errors.As(err, &rejected):
+		return ProblemCredentialsRejected
+	case errors.As(err, &extraction):
+		return ProblemTokenExtractionFailed
+	case errors.As(err, &controlPlane):
+		if isTimeout(err) {
+			return ProblemTimeout
+		}
+		return ProblemControlPlaneUnavailable
+	case errors.As(err, &authEndpoint):
+		if isTimeout(err) {
+			return ProblemTimeout
+		}
+		return ProblemAuthEndpointUnavailable
+	default:
+		return ProblemInternal
+	}
+}
+
+// isTimeout reports whether an error was caused by a deadline or a network timeout
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// newProblem returns the problem details of a problem type with the configured status code
+func newProblem(config *ErrorResponsesConfig, problemType string, id string) *ProblemDetails {
+	return &ProblemDetails{
+		Type:          config.GetTypeBase() + problemType,
+		Title:         problemTitles[problemType],
+		Status:        config.GetStatusCode(problemType),
+		Detail:        problemDetails[problemType],
+		CorrelationId: id,
+	}
+}
+
+// correlationId returns the correlation ID of a request, taken from the configured header or generated
+func correlationId(req *http.Request, config *ErrorResponsesConfig) string {
+	if id := req.Header.Get(config.GetCorrelationIdHeader()); id != "" {
+		return id
+	}
+	id, err := newUUID()
+	if err != nil {
+		return "unknown"
+	}
+	return id
+}
+
+// writeProblem writes problem details as an application/problem+json response
+func writeProblem(rw http.ResponseWriter, config *ErrorResponsesConfig, problem *ProblemDetails) {
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.Header().Set(config.GetCorrelationIdHeader(), problem.CorrelationId)
+	rw.WriteHeader(problem.Status)
+	json.NewEncoder(rw).Encode(problem)
+}
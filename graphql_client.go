@@ -2,17 +2,25 @@ package traefik_token_injector
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // GraphQLClient handles communication with the GraphQL API
 type GraphQLClient struct {
 	config     *GlobalConfig
 	httpClient *http.Client
+	ctx        context.Context
 }
 
 // NewGraphQLClient creates a new GraphQL client
@@ -30,91 +38,336 @@ func NewGraphQLClient(config *GlobalConfig) (*GraphQLClient, error) {
 	}, nil
 }
 
+// WithContext returns a copy of the client sending its requests with ctx
+// The trace of the span in ctx is propagated to the GraphQL API
+func (c *GraphQLClient) WithContext(ctx context.Context) *GraphQLClient {
+	bound := *c
+	bound.ctx = ctx
+	return &bound
+}
+
+// context returns the context requests are sent with
+func (c *GraphQLClient) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// endpointConnectionFields is the selection set of an endpoint connection
+const endpointConnectionFields = `
+	edges {
+		node {
+			... on EndpointType {
+				_id
+				method
+				path
+				description
+				tags
+				parameters {
+					type
+					value
+					required
+					location
+					description
+					default
+				}
+				responseBody {
+					contentType
+					contentSchema
+					description
+				}
+				requestBody {
+					contentType
+					contentSchema
+					description
+					required
+				}
+			}
+			... on GqlOperationType {
+				_id
+				name
+				operationType
+				description
+				arguments
+				result
+				url
+			}
+		}
+	}
+	pageInfo {
+		hasNextPage
+		endCursor
+	}
+`
+
+// instanceFieldsFormat is the selection set of an instance node, formatted with the written-back
+// token expiry selection, the endpoint page size and the endpoint connection fields
+const instanceFieldsFormat = `
+	_id
+	name
+	type
+	service_host
+	service_path
+	remote_host
+	remote_path
+	version_id
+	created_at
+	updated_at
+	operations
+	headers {
+		key
+		value
+		operation
+		template
+	}
+	response_headers {
+		key
+		value
+		operation
+		template
+	}
+	credentials {
+		apiKey
+		token%s
+		tokenLocation
+		tokenTtl
+		credentialData {
+			key
+			value
+			template
+			totp {
+				secret
+				algorithm
+				digits
+				period
+			}
+		}
+		endpointType
+		authType
+		endpointData(first: %d) {%s}
+		loginSteps {
+			name
+			credentialData {
+				key
+				value
+				template
+				totp {
+					secret
+					algorithm
+					digits
+					period
+				}
+			}
+			extract {
+				name
+				source
+				location
+			}
+			endpoint {
+				... on EndpointType {
+					_id
+					method
+					path
+					parameters {
+						type
+						value
+						required
+						location
+						description
+						default
+					}
+					requestBody {
+						contentType
+						contentSchema
+						description
+						required
+					}
+				}
+				... on GqlOperationType {
+					_id
+					name
+					operationType
+					arguments
+					result
+					url
+				}
+			}
+		}
+	}
+
+`
+
+// errNoInstance is wrapped by the InstanceNotFoundError returned when no instance matches a search
+var errNoInstance = errors.New("no instance found")
+
+// errAmbiguousInstance is wrapped by the errors returned when several instances match a search
+var errAmbiguousInstance = errors.New("ambiguous instance lookup")
+
 // FetchInstanceById fetches instance data by ID from the GraphQL API
 func (c *GraphQLClient) FetchInstanceById(instanceId string) (*InstanceType, error) {
+	instances, err := c.FetchInstances([]SearchCondition{{Field: "_id", Value: instanceId, Kind: "ID", Operator: "EQ"}})
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, &InstanceNotFoundError{Err: fmt.Errorf("%w with ID: %s", errNoInstance, instanceId)}
+	}
+
+	return instances[0], nil
+}
+
+// FetchInstance fetches the single instance matching the search conditions
+// The lookup fails if no instance or more than one instance matches
+func (c *GraphQLClient) FetchInstance(conditions []SearchCondition) (*InstanceType, error) {
+	instances, err := c.FetchInstances(conditions)
+	if err != nil {
+		return nil, err
+	}
+	return singleInstance(instances, conditions)
+}
+
+// singleInstance returns the only instance of a search result
+// It fails if no instance or more than one instance matched the search conditions
+func singleInstance(instances []*InstanceType, conditions []SearchCondition) (*InstanceType, error) {
+	switch len(instances) {
+	case 0:
+		return nil, &InstanceNotFoundError{Err: fmt.Errorf("%w matching %s", errNoInstance, describeSearch(conditions))}
+	case 1:
+		return instances[0], nil
+	}
+
+	// Report the matching IDs in a stable order so the failure is deterministic
+	ids := make([]string, len(instances))
+	for i, instance := range instances {
+		ids[i] = instance.ID
+	}
+	sort.Strings(ids)
+	return nil, fmt.Errorf("%w: %d instances match %s (%s)", errAmbiguousInstance, len(ids), describeSearch(conditions), strings.Join(ids, ", "))
+}
+
+// FetchInstances fetches all instances matching the search conditions from the GraphQL API
+// Every page of the connection is fetched, up to the configured page limit
+func (c *GraphQLClient) FetchInstances(conditions []SearchCondition) ([]*InstanceType, error) {
+	var instances []*InstanceType
+
+	err := c.pageIterator().Walk(func(first int, after string) (*PageInfo, error) {
+		page, pageInfo, err := c.ListInstances(conditions, first, after)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, page...)
+		return pageInfo, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Complete the endpoints of instances with more than one page of endpoints
+	for _, instance := range instances {
+		if err := c.fetchRemainingEndpoints(instance); err != nil {
+			return nil, fmt.Errorf("failed to fetch endpoints of instance %s: %w", instance.ID, err)
+		}
+	}
+
+	return instances, nil
+}
+
+// ListInstances fetches one page of the instances matching the search conditions
+// Pass the end cursor of the previous page as after to fetch the next page
+func (c *GraphQLClient) ListInstances(conditions []SearchCondition, first int, after string) ([]*InstanceType, *PageInfo, error) {
+	search, declarations, variables, err := buildSearch(conditions)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Build the GraphQL query
 	query := `
-		query instance($id: String!) {
+		query instances` + declarations + ` {
 			getInstances(
 				queryInput: {
-					search: [
-						{
-							field: "_id"
-							value: {
-								value: $id
-								kind: ID
-								operator: EQ
-							}
-						}
-					]
+					search: ` + search + `
+				}
+				` + buildPaginationArguments(first, after) + `
+			) {
+				edges {
+					node {` + c.instanceFields() + `}
+				}
+				pageInfo {
+					hasNextPage
+					endCursor
+				}
+			}
+		}
+	`
+
+	gqlResp, err := c.execute(GraphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if gqlResp.Data == nil || gqlResp.Data.GetInstances == nil {
+		return nil, &PageInfo{}, nil
+	}
+
+	instances := make([]*InstanceType, 0, len(gqlResp.Data.GetInstances.Edges))
+	for _, edge := range gqlResp.Data.GetInstances.Edges {
+		if edge.Node == nil {
+			return nil, nil, fmt.Errorf("instance node is nil")
+		}
+		instances = append(instances, edge.Node)
+	}
+
+	return instances, gqlResp.Data.GetInstances.PageInfo, nil
+}
+
+// fetchRemainingEndpoints fetches the endpoint pages following the first page of an instance
+func (c *GraphQLClient) fetchRemainingEndpoints(instance *InstanceType) error {
+	if instance.Credentials == nil || instance.Credentials.EndpointData == nil {
+		return nil
+	}
+	endpoints := instance.Credentials.EndpointData
+	if endpoints.PageInfo == nil || !endpoints.PageInfo.HasNextPage {
+		return nil
+	}
+
+	// The first page was fetched with the instance, continue after its cursor
+	firstPage := true
+	return c.pageIterator().Walk(func(first int, after string) (*PageInfo, error) {
+		if firstPage {
+			firstPage = false
+			return endpoints.PageInfo, nil
+		}
+
+		page, err := c.fetchEndpointPage(instance.ID, first, after)
+		if err != nil {
+			return nil, err
+		}
+		endpoints.Edges = append(endpoints.Edges, page.Edges...)
+		endpoints.PageInfo = page.PageInfo
+		return page.PageInfo, nil
+	})
+}
+
+// fetchEndpointPage fetches one page of the authentication endpoints of an instance
+func (c *GraphQLClient) fetchEndpointPage(instanceId string, first int, after string) (*EndpointConnection, error) {
+	search, declarations, variables, err := buildSearch([]SearchCondition{{Field: "_id", Value: instanceId, Kind: "ID", Operator: "EQ"}})
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the GraphQL query
+	query := `
+		query instanceEndpoints` + declarations + ` {
+			getInstances(
+				queryInput: {
+					search: ` + search + `
 				}
 			) {
 				edges {
 					node {
-						_id
-						name
-						type
-						service_host
-						service_path
-						remote_host
-						remote_path
-						version_id
-						operations
-						headers {
-							key
-							value
-						}
 						credentials {
-							apiKey
-							token
-							tokenLocation
-							tokenTtl
-							credentialData {
-								key
-								value
-							}
-							endpointType
-							authType
-							endpointData {
-								edges {
-									node {
-										... on EndpointType {
-											_id
-											method
-											path
-											description
-											tags
-											parameters {
-												type
-												value
-												required
-												location
-												description
-												default
-											}
-											responseBody {
-												contentType
-												contentSchema
-												description
-											}
-											requestBody {
-												contentType
-												contentSchema
-												description
-												required
-											}
-										}
-										... on GqlOperationType {
-											_id
-											name
-											operationType
-											description
-											arguments
-											result
-										}
-									}
-								}
-							}
+							endpointData(` + buildPaginationArguments(first, after) + `) {` + endpointConnectionFields + `}
 						}
 					}
 				}
@@ -122,35 +375,78 @@ func (c *GraphQLClient) FetchInstanceById(instanceId string) (*InstanceType, err
 		}
 	`
 
-	// Create request body
-	reqBody := GraphQLRequest{
-		Query: query,
-		Variables: map[string]interface{}{
-			"id": instanceId,
-		},
+	gqlResp, err := c.execute(GraphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		return nil, err
 	}
 
+	if gqlResp.Data == nil || gqlResp.Data.GetInstances == nil || len(gqlResp.Data.GetInstances.Edges) == 0 {
+		return nil, &InstanceNotFoundError{Err: fmt.Errorf("%w with ID: %s", errNoInstance, instanceId)}
+	}
+	node := gqlResp.Data.GetInstances.Edges[0].Node
+	if node == nil || node.Credentials == nil || node.Credentials.EndpointData == nil {
+		return &EndpointConnection{}, nil
+	}
+
+	return node.Credentials.EndpointData, nil
+}
+
+// instanceFields returns the selection set of an instance node
+// The written-back token expiry is selected under the tokenExpiresAt alias when its field is configured
+func (c *GraphQLClient) instanceFields() string {
+	var expiresAt string
+	if c.config.TokenWriteBack != nil && c.config.TokenWriteBack.ExpiresAtField != "" {
+		expiresAt = "\n\t\ttokenExpiresAt: " + c.config.TokenWriteBack.ExpiresAtField
+	}
+	return fmt.Sprintf(instanceFieldsFormat, expiresAt, c.config.PageSize, endpointConnectionFields)
+}
+
+// pageIterator returns an iterator using the configured page size and page limit
+func (c *GraphQLClient) pageIterator() PageIterator {
+	return PageIterator{PageSize: c.config.PageSize, MaxPages: c.config.MaxPages}
+}
+
+// execute sends a GraphQL request to the API and returns the parsed response
+func (c *GraphQLClient) execute(reqBody GraphQLRequest) (result *GraphQLResponse, err error) {
+	start := time.Now()
+	defer graphqlFetchDuration.ObserveSince(start)
+
+	ctx, span := StartSpan(c.context(), "graphql_fetch", SpanKindClient)
+	defer func() {
+		// Every failure to get a response means the control plane cannot serve instance data
+		if err != nil {
+			err = &ControlPlaneUnavailableError{Err: err}
+		}
+		span.RecordError(err)
+		span.End()
+	}()
+
 	reqData, err := json.Marshal(reqBody)
 	if err != nil {
+		graphqlFetchErrors.Inc("request")
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
 	// Create HTTP request
-	req, err := http.NewRequest("POST", c.config.GraphQLAPIURL, bytes.NewBuffer(reqData))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.config.GraphQLAPIURL, bytes.NewBuffer(reqData))
 	if err != nil {
+		graphqlFetchErrors.Inc("request")
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	InjectTraceparent(ctx, req.Header)
 
 	// Add authentication if configured
 	if err := c.addAuthentication(req); err != nil {
+		graphqlFetchErrors.Inc("request")
 		return nil, fmt.Errorf("failed to add authentication: %w", err)
 	}
 
 	// Execute request
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		graphqlFetchErrors.Inc("transport")
 		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 	defer resp.Body.Close()
@@ -158,36 +454,92 @@ func (c *GraphQLClient) FetchInstanceById(instanceId string) (*InstanceType, err
 	// Read response
 	respData, err := io.ReadAll(resp.Body)
 	if err != nil {
+		graphqlFetchErrors.Inc("transport")
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
 	// Check status code
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GraphQL API returned status %d: %s", resp.StatusCode, string(respData))
+		graphqlFetchErrors.Inc("status")
+		return nil, fmt.Errorf("GraphQL API returned status %d", resp.StatusCode)
 	}
 
 	// Parse response
 	var gqlResp GraphQLResponse
 	if err := json.Unmarshal(respData, &gqlResp); err != nil {
+		graphqlFetchErrors.Inc("decode")
 		return nil, fmt.Errorf("failed to parse response: %w", err)
 	}
 
 	// Check for GraphQL errors
 	if len(gqlResp.Errors) > 0 {
+		graphqlFetchErrors.Inc("graphql")
 		return nil, fmt.Errorf("GraphQL error: %s", gqlResp.Errors[0].Message)
 	}
 
-	// Extract instance data
-	if gqlResp.Data == nil || gqlResp.Data.GetInstances == nil || len(gqlResp.Data.GetInstances.Edges) == 0 {
-		return nil, fmt.Errorf("no instance found with ID: %s", instanceId)
+	return &gqlResp, nil
+}
+
+// describeSearch returns a human readable description of search conditions for error messages
+func describeSearch(conditions []SearchCondition) string {
+	parts := make([]string, len(conditions))
+	for i, condition := range conditions {
+		operator := condition.Operator
+		if operator == "" {
+			operator = "EQ"
+		}
+		parts[i] = fmt.Sprintf("%s %s %q", condition.Field, strings.ToUpper(operator), condition.Value)
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// searchEnumPattern matches the kind and operator enum values of a search condition
+var searchEnumPattern = regexp.MustCompile(`^[A-Z_]+$`)
+
+// searchEnums returns the kind and operator of a search condition in upper case, with their defaults
+// Both are GraphQL enum values written into the query, so anything but a plain enum name is rejected
+func searchEnums(condition SearchCondition) (kind string, operator string, err error) {
+	kind = strings.ToUpper(condition.Kind)
+	if kind == "" {
+		kind = "STRING"
 	}
+	operator = strings.ToUpper(condition.Operator)
+	if operator == "" {
+		operator = "EQ"
+	}
+
+	if !searchEnumPattern.MatchString(kind) {
+		return "", "", fmt.Errorf("invalid search kind %q for field %q", condition.Kind, condition.Field)
+	}
+	if !searchEnumPattern.MatchString(operator) {
+		return "", "", fmt.Errorf("invalid search operator %q for field %q", condition.Operator, condition.Field)
+	}
+	return kind, operator, nil
+}
+
+// buildSearch builds the getInstances search list of a query and its variables
+// Values are passed as query variables, never written into the query text
+func buildSearch(conditions []SearchCondition) (search string, declarations string, variables map[string]interface{}, err error) {
+	items := make([]string, len(conditions))
+	params := make([]string, len(conditions))
+	variables = make(map[string]interface{}, len(conditions))
+	for i, condition := range conditions {
+		kind, operator, err := searchEnums(condition)
+		if err != nil {
+			return "", "", nil, err
+		}
 
-	instance := gqlResp.Data.GetInstances.Edges[0].Node
-	if instance == nil {
-		return nil, fmt.Errorf("instance node is nil")
+		name := "v" + strconv.Itoa(i)
+		field, _ := json.Marshal(condition.Field)
+		items[i] = fmt.Sprintf("{ field: %s, value: { value: $%s, kind: %s, operator: %s } }", field, name, kind, operator)
+		params[i] = "$" + name + ": String!"
+		variables[name] = condition.Value
 	}
 
-	return instance, nil
+	if len(params) > 0 {
+		declarations = "(" + strings.Join(params, ", ") + ")"
+	}
+	return "[" + strings.Join(items, ", ") + "]", declarations, variables, nil
 }
 
 // addAuthentication adds authentication headers to the request based on config
@@ -0,0 +1,570 @@
+package traefik_token_injector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxInspectedBodySize limits how much of a request body is read to determine the operations
+const maxInspectedBodySize = 1 << 20
+
+// GraphQLOperation describes an operation parsed from a GraphQL request
+type GraphQLOperation struct {
+	Name   string   // Operation name, empty for anonymous operations
+	Type   string   // query, mutation, subscription
+	Fields []string // Top-level fields of the selection set
+}
+
+// GraphQLRequestInfo describes the operations executed by a GraphQL request
+type GraphQLRequestInfo struct {
+	Operations []GraphQLOperation // One operation per request, several for batched requests
+	Batched    bool
+}
+
+// graphQLPayload is a single GraphQL request as sent over HTTP
+type graphQLPayload struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// graphQLInfoKey is the context key of the parsed GraphQL request
+type graphQLInfoKey struct{}
+
+// WithGraphQLRequestInfo returns a context carrying the parsed GraphQL request
+func WithGraphQLRequestInfo(ctx context.Context, info *GraphQLRequestInfo) context.Context {
+	return context.WithValue(ctx, graphQLInfoKey{}, info)
+}
+
+// GraphQLRequestInfoFromContext returns the parsed GraphQL request stored in the context, if any
+func GraphQLRequestInfoFromContext(ctx context.Context) *GraphQLRequestInfo {
+	info, _ := ctx.Value(graphQLInfoKey{}).(*GraphQLRequestInfo)
+	return info
+}
+
+// InspectGraphQLRequest parses the GraphQL operations of an incoming request
+// Supports GET query strings, POST JSON bodies (single and batched) and application/graphql bodies
+// The request body is restored so it can still be forwarded to the upstream
+func InspectGraphQLRequest(req *http.Request) (*GraphQLRequestInfo, error) {
+	var payloads []graphQLPayload
+	batched := false
+
+	if req.Method == http.MethodGet {
+		query := req.URL.Query()
+		// Upstreams disagree on which of repeated parameters they use, so the checked one may not be the executed one
+		if len(query["query"]) > 1 || len(query["operationName"]) > 1 {
+			return nil, fmt.Errorf("GraphQL request repeats the query or operationName parameter")
+		}
+		payloads = append(payloads, graphQLPayload{Query: query.Get("query"), OperationName: query.Get("operationName")})
+	} else {
+		body, err := peekRequestBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		trimmed := bytes.TrimSpace(body)
+
+		switch {
+		case mediaType == "application/graphql":
+			payloads = append(payloads, graphQLPayload{Query: string(body)})
+
+		case len(trimmed) > 0 && trimmed[0] == '[':
+			batched = true
+			var items []json.RawMessage
+			if err := json.Unmarshal(trimmed, &items); err != nil {
+				return nil, fmt.Errorf("failed to parse batched GraphQL request: %w", err)
+			}
+			for i, item := range items {
+				payload, err := decodeGraphQLPayload(item)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse batched request %d: %w", i, err)
+				}
+				payloads = append(payloads, *payload)
+			}
+
+		default:
+			payload, err := decodeGraphQLPayload(trimmed)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse GraphQL request: %w", err)
+			}
+			payloads = append(payloads, *payload)
+		}
+	}
+
+	if len(payloads) == 0 {
+		return nil, fmt.Errorf("GraphQL request contains no operations")
+	}
+
+	info := &GraphQLRequestInfo{Batched: batched}
+	for i, payload := range payloads {
+		operation, err := ParseGraphQLOperation(payload.Query, payload.OperationName)
+		if err != nil {
+			if batched {
+				return nil, fmt.Errorf("batched request %d: %w", i, err)
+			}
+			return nil, err
+		}
+		info.Operations = append(info.Operations, *operation)
+	}
+
+	return info, nil
+}
+
+// decodeGraphQLPayload decodes a single GraphQL request object
+// json.Unmarshal matches keys case-insensitively and keeps the last duplicate, while upstreams read the exact
+// key, so a duplicate or case-variant query or operationName key could hide the executed operation
+func decodeGraphQLPayload(data []byte) (*graphQLPayload, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("GraphQL request is not a JSON object")
+	}
+
+	payload := &graphQLPayload{}
+	seen := make(map[string]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := token.(string)
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+
+		lower := strings.ToLower(key)
+		if lower != "query" && lower != "operationname" {
+			continue
+		}
+		if key != "query" && key != "operationName" {
+			return nil, fmt.Errorf("GraphQL request has key %q, only the exact keys query and operationName are accepted", key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("GraphQL request repeats the %s key", key)
+		}
+		seen[key] = true
+
+		target := &payload.Query
+		if key == "operationName" {
+			target = &payload.OperationName
+		}
+		if string(value) != "null" {
+			if err := json.Unmarshal(value, target); err != nil {
+				return nil, fmt.Errorf("GraphQL request %s is not a string", key)
+			}
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// peekRequestBody reads up to maxInspectedBodySize bytes of the request body and restores it
+func peekRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, fmt.Errorf("request has no body")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxInspectedBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	// Restore the body, including any unread remainder, for the upstream
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+
+	if len(body) > maxInspectedBodySize {
+		return nil, fmt.Errorf("request body exceeds %d bytes", maxInspectedBodySize)
+	}
+	return body, nil
+}
+
+// ParseGraphQLOperation parses a GraphQL document and returns the operation that will be executed
+// If the document defines several operations, operationName selects the executed one
+func ParseGraphQLOperation(query string, operationName string) (*GraphQLOperation, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("GraphQL query is empty")
+	}
+
+	doc, err := parseGraphQLDocument(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GraphQL query: %w", err)
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("GraphQL query defines no operation")
+	}
+
+	// Select the executed operation
+	var selected *graphQLDefinition
+	if operationName != "" {
+		for i := range doc.operations {
+			if doc.operations[i].name == operationName {
+				selected = &doc.operations[i]
+				break
+			}
+		}
+		if selected == nil {
+			return nil, fmt.Errorf("operation '%s' not found in GraphQL query", operationName)
+		}
+	} else if len(doc.operations) == 1 {
+		selected = &doc.operations[0]
+	} else {
+		return nil, fmt.Errorf("operationName is required when the query defines several operations")
+	}
+
+	return &GraphQLOperation{
+		Name:   selected.name,
+		Type:   selected.kind,
+		Fields: doc.expandFields(selected.selections, map[string]bool{}),
+	}, nil
+}
+
+// graphQLDocument holds the operations and fragments of a parsed document
+type graphQLDocument struct {
+	operations []graphQLDefinition
+	fragments  map[string]graphQLDefinition
+}
+
+// graphQLDefinition is an operation or fragment definition with its top-level selections
+type graphQLDefinition struct {
+	kind       string
+	name       string
+	selections []string // Field names, fragment spreads are prefixed with "..."
+}
+
+// expandFields resolves fragment spreads into the top-level fields they select
+func (d *graphQLDocument) expandFields(selections []string, visited map[string]bool) []string {
+	fields := make([]string, 0, len(selections))
+	for _, selection := range selections {
+		if !strings.HasPrefix(selection, "...") {
+			fields = appendUnique(fields, selection)
+			continue
+		}
+
+		name := strings.TrimPrefix(selection, "...")
+		fragment, ok := d.fragments[name]
+		if !ok || visited[name] {
+			continue
+		}
+		visited[name] = true
+		for _, field := range d.expandFields(fragment.selections, visited) {
+			fields = appendUnique(fields, field)
+		}
+	}
+	return fields
+}
+
+// appendUnique appends a value to a slice if it is not present yet
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// parseGraphQLDocument parses the definitions of a GraphQL document
+// Only the structure needed to find operations and their top-level fields is parsed
+func parseGraphQLDocument(query string) (*graphQLDocument, error) {
+	tokens, err := lexGraphQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &graphQLParser{tokens: tokens}
+	doc := &graphQLDocument{fragments: make(map[string]graphQLDefinition)}
+
+	for !p.done() {
+		switch tok := p.next(); tok {
+		case "{":
+			// Anonymous query shorthand
+			selections, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, graphQLDefinition{kind: "query", selections: selections})
+
+		case "query", "mutation", "subscription":
+			def := graphQLDefinition{kind: tok}
+			if isGraphQLName(p.peek()) {
+				def.name = p.next()
+			}
+			if p.peek() == "(" {
+				p.next()
+				if err := p.skipBalanced("(", ")"); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.skipDirectives(); err != nil {
+				return nil, err
+			}
+			if p.next() != "{" {
+				return nil, fmt.Errorf("expected selection set for %s %s", def.kind, def.name)
+			}
+			selections, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			def.selections = selections
+			doc.operations = append(doc.operations, def)
+
+		case "fragment":
+			def := graphQLDefinition{kind: tok, name: p.next()}
+			if p.next() != "on" || !isGraphQLName(p.next()) {
+				return nil, fmt.Errorf("invalid type condition for fragment %s", def.name)
+			}
+			if err := p.skipDirectives(); err != nil {
+				return nil, err
+			}
+			if p.next() != "{" {
+				return nil, fmt.Errorf("expected selection set for fragment %s", def.name)
+			}
+			selections, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			def.selections = selections
+			doc.fragments[def.name] = def
+
+		default:
+			return nil, fmt.Errorf("unexpected '%s'", tok)
+		}
+	}
+
+	return doc, nil
+}
+
+// graphQLParser walks the tokens of a GraphQL document
+type graphQLParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *graphQLParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *graphQLParser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *graphQLParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+// parseSelectionSet returns the top-level selections of a selection set whose "{" was consumed
+func (p *graphQLParser) parseSelectionSet() ([]string, error) {
+	var selections []string
+
+	for {
+		tok := p.next()
+		switch {
+		case tok == "":
+			return nil, fmt.Errorf("unterminated selection set")
+
+		case tok == "}":
+			return selections, nil
+
+		case tok == "...":
+			// Fragment spread or inline fragment
+			if p.peek() == "on" || p.peek() == "@" || p.peek() == "{" {
+				if p.peek() == "on" {
+					p.next()
+					p.next()
+				}
+				if err := p.skipDirectives(); err != nil {
+					return nil, err
+				}
+				if p.next() != "{" {
+					return nil, fmt.Errorf("expected selection set for inline fragment")
+				}
+				inline, err := p.parseSelectionSet()
+				if err != nil {
+					return nil, err
+				}
+				selections = append(selections, inline...)
+				continue
+			}
+			name := p.next()
+			if !isGraphQLName(name) {
+				return nil, fmt.Errorf("invalid fragment spread")
+			}
+			selections = append(selections, "..."+name)
+			if err := p.skipDirectives(); err != nil {
+				return nil, err
+			}
+
+		case isGraphQLName(tok):
+			// Field, with optional alias, arguments, directives and selection set
+			field := tok
+			if p.peek() == ":" {
+				p.next()
+				field = p.next()
+				if !isGraphQLName(field) {
+					return nil, fmt.Errorf("invalid field after alias '%s'", tok)
+				}
+			}
+			selections = append(selections, field)
+
+			if p.peek() == "(" {
+				p.next()
+				if err := p.skipBalanced("(", ")"); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.skipDirectives(); err != nil {
+				return nil, err
+			}
+			if p.peek() == "{" {
+				p.next()
+				if err := p.skipBalanced("{", "}"); err != nil {
+					return nil, err
+				}
+			}
+
+		default:
+			return nil, fmt.Errorf("unexpected '%s' in selection set", tok)
+		}
+	}
+}
+
+// skipDirectives skips any directives such as @include(if: $flag)
+func (p *graphQLParser) skipDirectives() error {
+	for p.peek() == "@" {
+		p.next()
+		if !isGraphQLName(p.next()) {
+			return fmt.Errorf("invalid directive")
+		}
+		if p.peek() == "(" {
+			p.next()
+			if err := p.skipBalanced("(", ")"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipBalanced skips tokens until the close token matching an already consumed open token
+func (p *graphQLParser) skipBalanced(open string, close string) error {
+	depth := 1
+	for depth > 0 {
+		switch p.next() {
+		case "":
+			return fmt.Errorf("missing '%s'", close)
+		case open:
+			depth++
+		case close:
+			depth--
+		}
+	}
+	return nil
+}
+
+// isGraphQLName reports whether a token is a GraphQL name
+func isGraphQLName(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	for i, c := range tok {
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// lexGraphQL splits a GraphQL document into tokens
+// Whitespace, commas and comments are dropped, string values are reduced to a placeholder token
+func lexGraphQL(query string) ([]string, error) {
+	var tokens []string
+	query = strings.TrimPrefix(query, "\ufeff")
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+
+		case c == '#':
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+
+		case strings.HasPrefix(query[i:], "..."):
+			tokens = append(tokens, "...")
+			i += 3
+
+		case strings.HasPrefix(query[i:], `"""`):
+			end := strings.Index(query[i+3:], `"""`)
+			for end >= 0 && query[i+3+end-1] == '\\' {
+				next := strings.Index(query[i+3+end+3:], `"""`)
+				if next < 0 {
+					end = -1
+					break
+				}
+				end += 3 + next
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated block string")
+			}
+			tokens = append(tokens, `""`)
+			i += 3 + end + 3
+
+		case c == '"':
+			j := i + 1
+			for j < len(query) && query[j] != '"' && query[j] != '\n' {
+				if query[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(query) || query[j] != '"' {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, `""`)
+			i = j + 1
+
+		case strings.IndexByte("{}()[]:!$@=|&", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+
+		default:
+			j := i
+			for j < len(query) && isGraphQLWordByte(query[j]) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected character '%c'", c)
+			}
+			tokens = append(tokens, query[i:j])
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+// isGraphQLWordByte reports whether a byte can be part of a name or number token
+func isGraphQLWordByte(c byte) bool {
+	return c == '_' || c == '-' || c == '+' || c == '.' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
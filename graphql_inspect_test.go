@@ -0,0 +1,242 @@
+package traefik_token_injector
+
+import (
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInspectGraphQLRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		operations  []GraphQLOperation
+		batched     bool
+	}{
+		{
+			name:       "GET query string",
+			method:     "GET",
+			target:     "/graphql?query=" + url.QueryEscape("query getUsers { users { id } }"),
+			operations: []GraphQLOperation{{Name: "getUsers", Type: "query", Fields: []string{"users"}}},
+		},
+		{
+			name:        "POST JSON",
+			method:      "POST",
+			contentType: "application/json",
+			body:        `{"query": "mutation createUser { createUser(name: \"a\") { id } }", "variables": {"query": "ignored"}}`,
+			operations:  []GraphQLOperation{{Name: "createUser", Type: "mutation", Fields: []string{"createUser"}}},
+		},
+		{
+			name:        "application/graphql",
+			method:      "POST",
+			contentType: "application/graphql; charset=utf-8",
+			body:        "{ users { id } account: me { id } }",
+			operations:  []GraphQLOperation{{Type: "query", Fields: []string{"users", "me"}}},
+		},
+		{
+			name:        "batched",
+			method:      "POST",
+			contentType: "application/json",
+			body:        `[{"query": "query a { users }"}, {"query": "query b { me } mutation c { logout }", "operationName": "c"}]`,
+			operations: []GraphQLOperation{
+				{Name: "a", Type: "query", Fields: []string{"users"}},
+				{Name: "c", Type: "mutation", Fields: []string{"logout"}},
+			},
+			batched: true,
+		},
+		{
+			name:        "selected operation",
+			method:      "POST",
+			contentType: "application/json",
+			body:        `{"query": "query getUsers { users } mutation deleteUser { deleteUser }", "operationName": "deleteUser"}`,
+			operations:  []GraphQLOperation{{Name: "deleteUser", Type: "mutation", Fields: []string{"deleteUser"}}},
+		},
+		{
+			name:        "null operationName",
+			method:      "POST",
+			contentType: "application/json",
+			body:        `{"query": "{ users }", "operationName": null}`,
+			operations:  []GraphQLOperation{{Type: "query", Fields: []string{"users"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := tt.target
+			if target == "" {
+				target = "/graphql"
+			}
+			req := httptest.NewRequest(tt.method, target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			info, err := InspectGraphQLRequest(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if info.Batched != tt.batched {
+				t.Errorf("Batched = %v, want %v", info.Batched, tt.batched)
+			}
+			if !reflect.DeepEqual(info.Operations, tt.operations) {
+				t.Errorf("operations = %+v, want %+v", info.Operations, tt.operations)
+			}
+		})
+	}
+}
+
+func TestInspectGraphQLRequestRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{name: "several operations without operationName", method: "POST", body: `{"query": "query a { users } query b { me }"}`},
+		{name: "unknown operationName", method: "POST", body: `{"query": "query a { users }", "operationName": "b"}`},
+		{name: "duplicate query key", method: "POST", body: `{"query": "{ users }", "query": "mutation { deleteUser }"}`},
+		{name: "duplicate operationName key", method: "POST", body: `{"query": "query a { users } mutation b { logout }", "operationName": "a", "operationName": "b"}`},
+		{name: "case-variant query key", method: "POST", body: `{"query": "{ users }", "Query": "mutation { deleteUser }"}`},
+		{name: "case-variant operationName key", method: "POST", body: `{"query": "query a { users }", "OperationName": "a"}`},
+		{name: "repeated GET query", method: "GET", target: "/graphql?query=%7Busers%7D&query=mutation%7BdeleteUser%7D"},
+		{name: "repeated GET operationName", method: "GET", target: "/graphql?query=query+a%7Busers%7D&operationName=a&operationName=b"},
+		{name: "empty GET query", method: "GET", target: "/graphql"},
+		{name: "non-string query", method: "POST", body: `{"query": 1}`},
+		{name: "not an object", method: "POST", body: `"{ users }"`},
+		{name: "truncated JSON", method: "POST", body: `{"query": "{ users }"`},
+		{name: "truncated query", method: "POST", body: `{"query": "query a { users { id }"}`},
+		{name: "empty body", method: "POST"},
+		{name: "empty batch", method: "POST", body: `[]`},
+		{name: "batch with a rejected item", method: "POST", body: `[{"query": "{ users }"}, {"query": "{ me }", "Query": "{ logout }"}]`},
+		{name: "oversized body", method: "POST", body: `{"query": "{ users }", "padding": "` + strings.Repeat("x", maxInspectedBodySize) + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := tt.target
+			if target == "" {
+				target = "/graphql"
+			}
+			req := httptest.NewRequest(tt.method, target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			if info, err := InspectGraphQLRequest(req); err == nil {
+				t.Errorf("request was accepted with operations %+v", info.Operations)
+			}
+		})
+	}
+}
+
+func TestInspectGraphQLRequestRestoresBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "inspected body", body: `{"query": "query getUsers { users }"}`},
+		{name: "oversized body", body: `{"query": "{ users }", "padding": "` + strings.Repeat("x", maxInspectedBodySize) + `"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/graphql", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			InspectGraphQLRequest(req)
+
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatalf("reading the restored body: %v", err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("restored body has %d bytes, want the %d bytes sent", len(body), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestParseGraphQLOperation(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		operationName string
+		want          *GraphQLOperation
+	}{
+		{
+			name:  "anonymous shorthand",
+			query: "{ users }",
+			want:  &GraphQLOperation{Type: "query", Fields: []string{"users"}},
+		},
+		{
+			name:  "anonymous query with variables",
+			query: "query ($id: ID!) { user(id: $id) { name } }",
+			want:  &GraphQLOperation{Type: "query", Fields: []string{"user"}},
+		},
+		{
+			name:          "selected among several",
+			query:         "query a { users } subscription b { events }",
+			operationName: "b",
+			want:          &GraphQLOperation{Name: "b", Type: "subscription", Fields: []string{"events"}},
+		},
+		{
+			name:  "comments containing braces",
+			query: "# mutation hidden { deleteUser }\nquery getUsers { # }\n users }",
+			want:  &GraphQLOperation{Name: "getUsers", Type: "query", Fields: []string{"users"}},
+		},
+		{
+			name:  "strings containing braces",
+			query: `query search { search(text: "} mutation { deleteUser }", note: """ { "" } """) { id } }`,
+			want:  &GraphQLOperation{Name: "search", Type: "query", Fields: []string{"search"}},
+		},
+		{
+			name:  "escaped quotes in strings",
+			query: `query search { search(text: "\" }", block: """ \""" } """) }`,
+			want:  &GraphQLOperation{Name: "search", Type: "query", Fields: []string{"search"}},
+		},
+		{
+			name:  "fragments and directives",
+			query: "query q @cached { ...userFields ... on Query { me } admin @include(if: true) } fragment userFields on Query { users ...more } fragment more on Query { roles }",
+			want:  &GraphQLOperation{Name: "q", Type: "query", Fields: []string{"users", "roles", "me", "admin"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGraphQLOperation(tt.query, tt.operationName)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLOperationErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "empty", query: "  "},
+		{name: "only fragments", query: "fragment f on Query { users }"},
+		{name: "several anonymous operations", query: "{ users } { me }"},
+		{name: "unterminated string", query: `{ search(text: "abc) }`},
+		{name: "unterminated block string", query: `{ search(text: """abc) }`},
+		{name: "unterminated selection set", query: "query a { users { id }"},
+		{name: "unexpected character", query: "query a { users % }"},
+		{name: "unexpected definition", query: "schema { query: Query }"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if operation, err := ParseGraphQLOperation(tt.query, ""); err == nil {
+				t.Errorf("query was accepted as %+v", operation)
+			}
+		})
+	}
+}
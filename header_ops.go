@@ -0,0 +1,152 @@
+package traefik_token_injector
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header operations supported by HeaderType
+const (
+	HeaderOperationSet         = "set"
+	HeaderOperationAppend      = "append"
+	HeaderOperationSetIfAbsent = "set_if_absent"
+	HeaderOperationRemove      = "remove"
+)
+
+// protectedHeaders lists headers that instance header operations must not modify
+var protectedHeaders = map[string]bool{
+	"Host":                true,
+	"Content-Length":      true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// GetOperation returns the normalized header operation, defaulting to set
+func (h HeaderType) GetOperation() string {
+	op := strings.ToLower(strings.ReplaceAll(h.Operation, "-", "_"))
+	if op == "" {
+		return HeaderOperationSet
+	}
+	return op
+}
+
+// ValidateHeaders validates the header operations of an instance
+func ValidateHeaders(headers []HeaderType) error {
+	for _, header := range headers {
+		if header.Key == "" {
+			return fmt.Errorf("header key is empty")
+		}
+
+		name := http.CanonicalHeaderKey(header.Key)
+		if protectedHeaders[name] {
+			return fmt.Errorf("header '%s' is protected and cannot be modified", name)
+		}
+
+		switch header.GetOperation() {
+		case HeaderOperationSet, HeaderOperationAppend, HeaderOperationSetIfAbsent, HeaderOperationRemove:
+			// Valid
+		default:
+			return fmt.Errorf("invalid operation '%s' for header '%s'", header.Operation, name)
+		}
+	}
+	return nil
+}
+
+// ResolveHeaders evaluates the templates in the values of headers marked as templates
+// Other values are used literally, even if they contain {{
+func ResolveHeaders(headers []HeaderType, tmpl *TemplateContext) ([]HeaderType, error) {
+	resolved := make([]HeaderType, len(headers))
+	for i, header := range headers {
+		if header.Template && header.GetOperation() != HeaderOperationRemove {
+			value, err := EvaluateTemplate(header.Value, tmpl)
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate header '%s': %w", header.Key, err)
+			}
+			header.Value = value
+		}
+		resolved[i] = header
+	}
+	return resolved, nil
+}
+
+// SplitRemovals separates the remove operations from the other header operations
+func SplitRemovals(headers []HeaderType) (removals []HeaderType, others []HeaderType) {
+	for _, header := range headers {
+		if header.GetOperation() == HeaderOperationRemove {
+			removals = append(removals, header)
+		} else {
+			others = append(others, header)
+		}
+	}
+	return removals, others
+}
+
+// ApplyHeaders applies resolved header operations to a header set
+func ApplyHeaders(target http.Header, headers []HeaderType) {
+	for _, header := range headers {
+		switch header.GetOperation() {
+		case HeaderOperationSet:
+			target.Set(header.Key, header.Value)
+		case HeaderOperationAppend:
+			target.Add(header.Key, header.Value)
+		case HeaderOperationSetIfAbsent:
+			if target.Get(header.Key) == "" {
+				target.Set(header.Key, header.Value)
+			}
+		case HeaderOperationRemove:
+			target.Del(header.Key)
+		}
+	}
+}
+
+// headerRewriteWriter applies header operations to the response before the headers are written
+type headerRewriteWriter struct {
+	http.ResponseWriter
+	headers     []HeaderType
+	wroteHeader bool
+}
+
+// newHeaderRewriteWriter wraps a response writer to apply the given header operations
+func newHeaderRewriteWriter(rw http.ResponseWriter, headers []HeaderType) *headerRewriteWriter {
+	return &headerRewriteWriter{ResponseWriter: rw, headers: headers}
+}
+
+// WriteHeader applies the header operations and writes the status code
+func (w *headerRewriteWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		ApplyHeaders(w.ResponseWriter.Header(), w.headers)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes the response body, writing the headers first if needed
+func (w *headerRewriteWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for streaming responses
+func (w *headerRewriteWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped response writer
+func (w *headerRewriteWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,98 @@
+package traefik_token_injector
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// InstanceCache is a size-bounded cache of instance lookups with TTL support
+// When full, the least recently used entry is evicted
+type InstanceCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+// instanceCacheEntry holds the instances found for a lookup key
+type instanceCacheEntry struct {
+	key       string
+	instances []*InstanceType
+	expiresAt time.Time
+}
+
+// NewInstanceCache creates a new instance cache
+func NewInstanceCache(maxEntries int, ttl time.Duration) *InstanceCache {
+	return &InstanceCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Get retrieves the instances cached for a lookup key
+func (c *InstanceCache) Get(key string) ([]*InstanceType, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*instanceCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.instances, true
+}
+
+// Set stores the instances found for a lookup key, evicting the least recently used entry if full
+func (c *InstanceCache) Set(key string, instances []*InstanceType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*instanceCacheEntry)
+		entry.instances = instances
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&instanceCacheEntry{key: key, instances: instances, expiresAt: expiresAt})
+
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*instanceCacheEntry).key)
+	}
+}
+
+// Delete removes a lookup key from the cache
+func (c *InstanceCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// Clear removes all entries from the cache
+func (c *InstanceCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
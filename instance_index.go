@@ -0,0 +1,349 @@
+package traefik_token_injector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InstanceIndex is an in-memory index of instances keyed by _id, name and service_host
+type InstanceIndex struct {
+	mu            sync.RWMutex
+	byId          map[string]*InstanceType
+	byName        map[string][]*InstanceType
+	byHost        map[string][]*InstanceType
+	lastUpdatedAt int
+	ready         bool
+}
+
+// NewInstanceIndex creates an empty instance index
+func NewInstanceIndex() *InstanceIndex {
+	return &InstanceIndex{
+		byId:   make(map[string]*InstanceType),
+		byName: make(map[string][]*InstanceType),
+		byHost: make(map[string][]*InstanceType),
+	}
+}
+
+// Ready reports whether the index has completed a full sync
+func (x *InstanceIndex) Ready() bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return x.ready
+}
+
+// Get returns an instance by ID
+func (x *InstanceIndex) Get(instanceId string) (*InstanceType, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	instance, ok := x.byId[instanceId]
+	return instance, ok
+}
+
+// Len returns the number of indexed instances
+func (x *InstanceIndex) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return len(x.byId)
+}
+
+// Find returns the instances matching the search conditions
+// It returns false if the index is not ready or a condition cannot be evaluated locally,
+// in which case the caller should query the GraphQL API instead
+func (x *InstanceIndex) Find(conditions []SearchCondition) ([]*InstanceType, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	if !x.ready || len(conditions) == 0 {
+		return nil, false
+	}
+	for _, condition := range conditions {
+		if !indexCanEvaluate(condition) {
+			return nil, false
+		}
+	}
+
+	// Narrow the candidates down using the keyed fields
+	var candidates []*InstanceType
+	switch first := conditions[0]; first.Field {
+	case "_id":
+		if instance, ok := x.byId[first.Value]; ok {
+			candidates = []*InstanceType{instance}
+		}
+	case "name":
+		candidates = x.byName[first.Value]
+	case "service_host":
+		candidates = x.byHost[strings.ToLower(first.Value)]
+	default:
+		for _, instance := range x.byId {
+			candidates = append(candidates, instance)
+		}
+	}
+
+	var matches []*InstanceType
+	for _, instance := range candidates {
+		if instanceMatches(instance, conditions) {
+			matches = append(matches, instance)
+		}
+	}
+
+	return matches, true
+}
+
+// Replace replaces the content of the index with a full list of instances
+func (x *InstanceIndex) Replace(instances []*InstanceType) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.byId = make(map[string]*InstanceType, len(instances))
+	x.lastUpdatedAt = 0
+	for _, instance := range instances {
+		x.byId[instance.ID] = instance
+		if instance.UpdatedAt > x.lastUpdatedAt {
+			x.lastUpdatedAt = instance.UpdatedAt
+		}
+	}
+	x.rebuildKeys()
+	x.ready = true
+}
+
+// Upsert adds or replaces instances in the index
+func (x *InstanceIndex) Upsert(instances []*InstanceType) {
+	if len(instances) == 0 {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, instance := range instances {
+		x.byId[instance.ID] = instance
+		if instance.UpdatedAt > x.lastUpdatedAt {
+			x.lastUpdatedAt = instance.UpdatedAt
+		}
+	}
+	x.rebuildKeys()
+}
+
+// Delete removes an instance from the index
+func (x *InstanceIndex) Delete(instanceId string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, ok := x.byId[instanceId]; ok {
+		delete(x.byId, instanceId)
+		x.rebuildKeys()
+	}
+}
+
+// LastUpdatedAt returns the most recent updated_at of the indexed instances
+func (x *InstanceIndex) LastUpdatedAt() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return x.lastUpdatedAt
+}
+
+// rebuildKeys rebuilds the secondary keys, the caller must hold the write lock
+func (x *InstanceIndex) rebuildKeys() {
+	x.byName = make(map[string][]*InstanceType)
+	x.byHost = make(map[string][]*InstanceType)
+	for _, instance := range x.byId {
+		x.byName[instance.Name] = append(x.byName[instance.Name], instance)
+		host := strings.ToLower(instance.ServiceHost)
+		x.byHost[host] = append(x.byHost[host], instance)
+	}
+}
+
+// findInstances returns the instances matching the conditions
+// The index is used when it has matches, otherwise the GraphQL API is queried: instances created
+// since the last sync are not indexed yet
+func findInstances(index *InstanceIndex, client *GraphQLClient, conditions []SearchCondition) ([]*InstanceType, error) {
+	if index != nil {
+		if instances, ok := index.Find(conditions); ok && len(instances) > 0 {
+			return instances, nil
+		}
+	}
+	return client.FetchInstances(conditions)
+}
+
+// indexCanEvaluate reports whether a search condition can be evaluated against the index
+func indexCanEvaluate(condition SearchCondition) bool {
+	if condition.Operator != "" && !strings.EqualFold(condition.Operator, "EQ") {
+		return false
+	}
+	_, ok := instanceField(&InstanceType{}, condition.Field)
+	return ok
+}
+
+// instanceMatches reports whether an instance matches all EQ search conditions
+func instanceMatches(instance *InstanceType, conditions []SearchCondition) bool {
+	for _, condition := range conditions {
+		value, _ := instanceField(instance, condition.Field)
+		if condition.Field == "service_host" {
+			if !strings.EqualFold(value, condition.Value) {
+				return false
+			}
+		} else if value != condition.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// instanceField returns the value of a searchable instance field
+func instanceField(instance *InstanceType, field string) (string, bool) {
+	switch field {
+	case "_id":
+		return instance.ID, true
+	case "name":
+		return instance.Name, true
+	case "type":
+		return instance.Type, true
+	case "service_host":
+		return instance.ServiceHost, true
+	case "service_path":
+		return instance.ServicePath, true
+	case "remote_host":
+		return instance.RemoteHost, true
+	case "remote_path":
+		return instance.RemotePath, true
+	case "version_id":
+		return instance.VersionID, true
+	default:
+		return "", false
+	}
+}
+
+// InstanceSyncer periodically lists all instances into an index
+type InstanceSyncer struct {
+	client       *GraphQLClient
+	index        *InstanceIndex
+	interval     time.Duration
+	fullInterval time.Duration
+	refs         int
+	stop         chan struct{}
+}
+
+var (
+	// instanceSyncersMu guards instanceSyncers
+	instanceSyncersMu sync.Mutex
+
+	// instanceSyncers holds the syncers shared by all middlewares of the process, keyed by GraphQL API
+	instanceSyncers = make(map[string]*InstanceSyncer)
+)
+
+// AcquireInstanceSyncer returns the syncer shared by all middlewares using the same GraphQL API,
+// starting its sync loop on first use. Call ReleaseInstanceSyncer when the middleware is stopped.
+func AcquireInstanceSyncer(client *GraphQLClient, config *GlobalConfig) (*InstanceSyncer, error) {
+	interval, err := config.GetSyncInterval()
+	if err != nil {
+		return nil, fmt.Errorf("invalid sync_interval: %w", err)
+	}
+	fullInterval, err := config.GetSyncFullInterval()
+	if err != nil {
+		return nil, fmt.Errorf("invalid sync_full_interval: %w", err)
+	}
+
+	instanceSyncersMu.Lock()
+	defer instanceSyncersMu.Unlock()
+
+	key := syncerKey(config)
+	syncer, ok := instanceSyncers[key]
+	if !ok {
+		syncer = &InstanceSyncer{
+			client:       client,
+			index:        NewInstanceIndex(),
+			interval:     interval,
+			fullInterval: fullInterval,
+			stop:         make(chan struct{}),
+		}
+		instanceSyncers[key] = syncer
+		go syncer.run()
+	}
+	syncer.refs++
+
+	return syncer, nil
+}
+
+// ReleaseInstanceSyncer releases a syncer, stopping its sync loop when no middleware uses it anymore
+func ReleaseInstanceSyncer(syncer *InstanceSyncer) {
+	instanceSyncersMu.Lock()
+	defer instanceSyncersMu.Unlock()
+
+	syncer.refs--
+	if syncer.refs > 0 {
+		return
+	}
+
+	close(syncer.stop)
+	for key, s := range instanceSyncers {
+		if s == syncer {
+			delete(instanceSyncers, key)
+		}
+	}
+}
+
+// syncerKey identifies the GraphQL API and credentials a syncer lists instances from
+func syncerKey(config *GlobalConfig) string {
+	return strings.Join([]string{config.GraphQLAPIURL, config.GraphQLAuthType, config.GraphQLUsername, config.GraphQLAPIToken}, "|")
+}
+
+// Index returns the index maintained by the syncer
+func (s *InstanceSyncer) Index() *InstanceIndex {
+	return s.index
+}
+
+// run syncs the index until the syncer is released
+func (s *InstanceSyncer) run() {
+	var lastFull time.Time
+
+	for {
+		if time.Since(lastFull) >= s.fullInterval || !s.index.Ready() {
+			if err := s.FullSync(); err != nil {
+				rootLogger.Warn("Full instance sync failed", "error", err)
+			} else {
+				lastFull = time.Now()
+			}
+		} else if err := s.IncrementalSync(); err != nil {
+			rootLogger.Warn("Incremental instance sync failed", "error", err)
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// FullSync lists all instances and replaces the content of the index
+func (s *InstanceSyncer) FullSync() error {
+	instances, err := s.client.FetchInstances(nil)
+	if err != nil {
+		return err
+	}
+
+	s.index.Replace(instances)
+	rootLogger.Info("Synced instances", "count", len(instances))
+	return nil
+}
+
+// IncrementalSync fetches the instances updated since the last sync and updates the index
+// Instances updated in the same second as the latest indexed one are fetched again, they may have
+// been written after the last sync; upserting them twice is harmless
+func (s *InstanceSyncer) IncrementalSync() error {
+	since := strconv.Itoa(s.index.LastUpdatedAt())
+	instances, err := s.client.FetchInstances([]SearchCondition{{Field: "updated_at", Value: since, Kind: "INT", Operator: "GTE"}})
+	if err != nil {
+		return err
+	}
+
+	s.index.Upsert(instances)
+	return nil
+}
@@ -0,0 +1,181 @@
+package traefik_token_injector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Instance selector sources
+const (
+	SelectorSourceHeader    = "header"
+	SelectorSourcePath      = "path"
+	SelectorSourceSubdomain = "subdomain"
+	SelectorSourceMatch     = "match"
+)
+
+// InstanceSelector selects the instance serving a request instead of a fixed serviceId
+type InstanceSelector struct {
+	config *InstanceSelectorConfig
+	client *GraphQLClient
+	cache  *InstanceCache
+	index  *InstanceIndex
+	pin    []SearchCondition
+}
+
+// NewInstanceSelector creates a new instance selector
+// The index is optional, when set it is used before the cache and the GraphQL API
+// The pin conditions are added to every lookup, e.g. to select a pinned version_id
+func NewInstanceSelector(config *InstanceSelectorConfig, client *GraphQLClient, index *InstanceIndex, pin []SearchCondition) (*InstanceSelector, error) {
+	ttl, err := config.GetCacheTtl()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cacheTtl: %w", err)
+	}
+
+	return &InstanceSelector{
+		config: config,
+		client: client,
+		cache:  NewInstanceCache(config.GetCacheSize(), ttl),
+		index:  index,
+		pin:    pin,
+	}, nil
+}
+
+// Select returns the instance for the request
+// The returned error wraps errNoInstance when no instance matches the request
+func (s *InstanceSelector) Select(req *http.Request) (*InstanceType, error) {
+	if s.config.Source == SelectorSourceMatch {
+		return s.selectByServiceLocation(req)
+	}
+
+	instanceId := s.instanceId(req)
+	if instanceId == "" {
+		return nil, &InstanceNotFoundError{Err: fmt.Errorf("%w: request carries no instance ID", errNoInstance)}
+	}
+
+	instances, err := s.lookup(req.Context(), "id|"+instanceId, s.withPin(SearchCondition{Field: "_id", Value: instanceId, Kind: "ID", Operator: "EQ"}))
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, &InstanceNotFoundError{Err: fmt.Errorf("%w with ID: %s", errNoInstance, instanceId)}
+	}
+
+	return instances[0], nil
+}
+
+// instanceId extracts the instance ID from the request according to the selector source
+func (s *InstanceSelector) instanceId(req *http.Request) string {
+	switch s.config.Source {
+	case SelectorSourceHeader:
+		return strings.TrimSpace(req.Header.Get(s.config.GetHeader()))
+
+	case SelectorSourcePath:
+		segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		index := s.config.GetPathSegment() - 1
+		if index < len(segments) {
+			return segments[index]
+		}
+		return ""
+
+	case SelectorSourceSubdomain:
+		host := requestHost(req)
+		if s.config.Domain != "" {
+			suffix := "." + strings.TrimPrefix(strings.ToLower(s.config.Domain), ".")
+			if !strings.HasSuffix(host, suffix) {
+				return ""
+			}
+			host = strings.TrimSuffix(host, suffix)
+		}
+		if i := strings.IndexByte(host, '.'); i >= 0 {
+			return host[:i]
+		}
+		if s.config.Domain != "" {
+			return host
+		}
+		return ""
+
+	default:
+		return ""
+	}
+}
+
+// selectByServiceLocation selects the instance whose service_host matches the request host
+// and whose service_path is the longest prefix of the request path
+func (s *InstanceSelector) selectByServiceLocation(req *http.Request) (*InstanceType, error) {
+	host := requestHost(req)
+
+	instances, err := s.lookup(req.Context(), "host|"+host, s.withPin(SearchCondition{Field: "service_host", Value: host, Kind: "STRING", Operator: "EQ"}))
+	if err != nil {
+		return nil, err
+	}
+
+	instance := matchServicePath(instances, req.URL.Path)
+	if instance == nil {
+		return nil, &InstanceNotFoundError{Err: fmt.Errorf("%w for %s%s", errNoInstance, host, req.URL.Path)}
+	}
+
+	return instance, nil
+}
+
+// lookup returns the instances for a lookup key from the index, the cache or the GraphQL API
+// Keys missing from the index are looked up as well, they may belong to instances created since the last sync.
+// Empty results are cached so unknown keys do not hit the API on every request
+func (s *InstanceSelector) lookup(ctx context.Context, key string, conditions []SearchCondition) ([]*InstanceType, error) {
+	if s.index != nil {
+		if instances, ok := s.index.Find(conditions); ok && len(instances) > 0 {
+			return instances, nil
+		}
+	}
+	if instances, ok := s.cache.Get(key); ok {
+		return instances, nil
+	}
+
+	instances, err := s.client.WithContext(ctx).FetchInstances(conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.Set(key, instances)
+	return instances, nil
+}
+
+// Invalidate drops all cached lookups, e.g. after the instance metadata was reloaded
+func (s *InstanceSelector) Invalidate() {
+	s.cache.Clear()
+}
+
+// withPin returns the search conditions with the pin conditions added
+func (s *InstanceSelector) withPin(condition SearchCondition) []SearchCondition {
+	return append([]SearchCondition{condition}, s.pin...)
+}
+
+// matchServicePath returns the instance whose service_path is the longest prefix of the path
+func matchServicePath(instances []*InstanceType, path string) *InstanceType {
+	var best *InstanceType
+	bestLen := -1
+
+	for _, instance := range instances {
+		servicePath := strings.TrimRight(instance.ServicePath, "/")
+		if servicePath != "" && path != servicePath && !strings.HasPrefix(path, servicePath+"/") {
+			continue
+		}
+		if len(servicePath) > bestLen {
+			best = instance
+			bestLen = len(servicePath)
+		}
+	}
+
+	return best
+}
+
+// requestHost returns the lower-cased request host without port
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,357 @@
+package traefik_token_injector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message
+type LogLevel int
+
+// Log levels in increasing severity
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// logLevelNames maps configuration values to log levels
+var logLevelNames = map[string]LogLevel{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+// String returns the name of the level
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// redacted replaces secrets in log output
+const redacted = "[REDACTED]"
+
+// sensitiveKeyPattern matches field and JSON keys whose values are secrets
+var sensitiveKeyPattern = regexp.MustCompile(`(?i)(token|password|passwd|secret|api[_-]?key|authorization|cookie|credentialdata)`)
+
+// secretPatterns match secrets embedded in messages and errors, e.g. in raw auth endpoint responses
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// "access_token": "...", "password":"..." in JSON bodies
+	{regexp.MustCompile(`(?i)("[^"]*(?:token|password|passwd|secret|api[_-]?key|authorization)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`), `$1"` + redacted + `"`},
+	// Authorization header values
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`), `$1 ` + redacted},
+	// token=..., password=... in query strings and form bodies
+	{regexp.MustCompile(`(?i)\b([a-z_]*(?:token|password|passwd|secret|api[_-]?key)[a-z_]*)=[^\s&"]+`), `$1=` + redacted},
+}
+
+// Logger writes leveled, structured log messages
+// Fields and messages are redacted: values of sensitive keys, registered secrets and
+// secret-looking patterns never reach the output
+type Logger struct {
+	core    *logCore
+	fields  []interface{} // Alternating keys and values
+	secrets []string
+}
+
+// logCore is the output shared by a logger and the loggers derived from it
+type logCore struct {
+	mu      sync.Mutex
+	out     io.Writer
+	level   LogLevel
+	json    bool
+	sampler *logSampler
+}
+
+// rootLogger is the logger of the process, configured from the global configuration
+var rootLogger = NewLogger(nil)
+
+// NewLogger creates a logger writing to stderr, with the defaults when config is nil
+func NewLogger(config *LoggingConfig) *Logger {
+	core := &logCore{out: os.Stderr}
+	core.configure(config)
+	return &Logger{core: core}
+}
+
+// ConfigureLogging applies the logging configuration to the logger of the process
+func ConfigureLogging(config *LoggingConfig) {
+	rootLogger.core.configure(config)
+}
+
+// configure applies a logging configuration
+func (c *logCore) configure(config *LoggingConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.level = LevelInfo
+	c.json = false
+	c.sampler = nil
+	if config == nil {
+		return
+	}
+
+	if level, ok := logLevelNames[config.Level]; ok {
+		c.level = level
+	}
+	c.json = config.Format == "json"
+	if config.Sampling != nil {
+		interval, _ := config.Sampling.GetInterval()
+		c.sampler = newLogSampler(config.Sampling.Initial, config.Sampling.Thereafter, interval)
+	}
+}
+
+// With returns a logger adding the key-value pairs to every message
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	derived := *l
+	derived.fields = append(append([]interface{}{}, l.fields...), keyValues...)
+	return &derived
+}
+
+// WithSecrets returns a logger redacting the given values wherever they appear
+// Values shorter than 4 characters are ignored, they would redact unrelated text
+func (l *Logger) WithSecrets(secrets ...string) *Logger {
+	derived := *l
+	derived.secrets = append([]string{}, l.secrets...)
+	for _, secret := range secrets {
+		if len(secret) >= 4 {
+			derived.secrets = append(derived.secrets, secret)
+		}
+	}
+	return &derived
+}
+
+// Debug logs a message for troubleshooting, subject to sampling
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(LevelDebug, true, msg, keyValues)
+}
+
+// Info logs a routine message, subject to sampling
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(LevelInfo, true, msg, keyValues)
+}
+
+// Warn logs a message about a recoverable problem
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(LevelWarn, false, msg, keyValues)
+}
+
+// Error logs a message about a failure
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(LevelError, false, msg, keyValues)
+}
+
+// Audit logs a security relevant message at info level, it is never sampled
+func (l *Logger) Audit(msg string, keyValues ...interface{}) {
+	l.log(LevelInfo, false, msg, append([]interface{}{"audit", true}, keyValues...))
+}
+
+// log formats and writes a message
+func (l *Logger) log(level LogLevel, sampled bool, msg string, keyValues []interface{}) {
+	core := l.core
+	core.mu.Lock()
+	defer core.mu.Unlock()
+
+	if level < core.level {
+		return
+	}
+	if sampled && core.sampler != nil && !core.sampler.allow(level, msg) {
+		return
+	}
+
+	fields := append(append([]interface{}{}, l.fields...), keyValues...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	var buf bytes.Buffer
+	now := time.Now()
+	if core.json {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, l.redact(msg))
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			buf.WriteByte(',')
+			writeJSONValue(&buf, key)
+			buf.WriteByte(':')
+			writeJSONValue(&buf, l.redactValue(key, fields[i+1]))
+		}
+		buf.WriteString("}\n")
+	} else {
+		buf.WriteString(now.Format("2006/01/02 15:04:05"))
+		buf.WriteString(" [TokenInjector] ")
+		buf.WriteString(strings.ToUpper(level.String()))
+		buf.WriteByte(' ')
+		buf.WriteString(l.redact(msg))
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			buf.WriteByte(' ')
+			buf.WriteString(key)
+			buf.WriteByte('=')
+			buf.WriteString(formatTextValue(l.redactValue(key, fields[i+1])))
+		}
+		buf.WriteByte('\n')
+	}
+
+	core.out.Write(buf.Bytes())
+}
+
+// redactValue returns a field value safe for output
+// Strings, errors and other values formatted as text are redacted, numbers and booleans are kept
+func (l *Logger) redactValue(key string, value interface{}) interface{} {
+	if sensitiveKeyPattern.MatchString(key) {
+		return redacted
+	}
+
+	switch v := value.(type) {
+	case nil, bool, int, int64, uint64, float64:
+		return v
+	case error:
+		return l.redact(v.Error())
+	case string:
+		return l.redact(v)
+	default:
+		return l.redact(fmt.Sprint(v))
+	}
+}
+
+// redact removes registered secrets and secret-looking patterns from text
+func (l *Logger) redact(text string) string {
+	for _, secret := range l.secrets {
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	for _, p := range secretPatterns {
+		text = p.pattern.ReplaceAllString(text, p.replacement)
+	}
+	return text
+}
+
+// RedactError returns err with its message redacted, for errors kept or exported outside the log
+// The returned error unwraps to err, so its type is still classified
+func (l *Logger) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{msg: l.redact(err.Error()), err: err}
+}
+
+// redactedError is an error with a redacted message
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactSecrets removes secret-looking patterns from text shown outside the log, e.g. by the admin API
+func redactSecrets(text string) string {
+	return rootLogger.redact(text)
+}
+
+// writeJSONValue writes a value as JSON
+func writeJSONValue(buf *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+// formatTextValue formats a value of the text format, quoting it when needed
+func formatTextValue(value interface{}) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+// credentialSecrets returns the secret values of credentials for redaction
+func credentialSecrets(credentials *CredentialsType) []string {
+	if credentials == nil {
+		return nil
+	}
+
+	secrets := credentialPairSecrets(credentials.CredentialData)
+	for _, step := range credentials.LoginSteps {
+		secrets = append(secrets, credentialPairSecrets(step.CredentialData)...)
+	}
+	if credentials.Token != nil {
+		secrets = append(secrets, *credentials.Token)
+	}
+	return append(secrets, credentials.ApiKey)
+}
+
+// credentialPairSecrets returns the values and TOTP secrets of credential pairs for redaction
+func credentialPairSecrets(credentialData []CredentialsPairType) []string {
+	var secrets []string
+	for _, pair := range credentialData {
+		secrets = append(secrets, pair.Value)
+		if pair.Totp != nil {
+			secrets = append(secrets, pair.Totp.Secret)
+		}
+	}
+	return secrets
+}
+
+// logSampler limits how often the same message is logged
+// In every interval the first messages are logged, then only every nth
+type logSampler struct {
+	initial    int
+	thereafter int
+	interval   time.Duration
+	counters   map[string]*sampleCounter
+}
+
+// sampleCounter counts the occurrences of a message in the current interval
+type sampleCounter struct {
+	start time.Time
+	count int
+}
+
+// newLogSampler creates a sampler
+func newLogSampler(initial int, thereafter int, interval time.Duration) *logSampler {
+	return &logSampler{initial: initial, thereafter: thereafter, interval: interval, counters: make(map[string]*sampleCounter)}
+}
+
+// allow reports whether a message is logged, the caller must hold the core lock
+func (s *logSampler) allow(level LogLevel, msg string) bool {
+	key := level.String() + "|" + msg
+	now := time.Now()
+
+	counter, ok := s.counters[key]
+	if !ok || now.Sub(counter.start) >= s.interval {
+		counter = &sampleCounter{start: now}
+		s.counters[key] = counter
+	}
+	counter.count++
+
+	if counter.count <= s.initial {
+		return true
+	}
+	return s.thereafter > 0 && (counter.count-s.initial)%s.thereafter == 0
+}
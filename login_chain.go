@@ -0,0 +1,136 @@
+package traefik_token_injector
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// stepReferencePattern matches references to values extracted by earlier login steps, e.g. ${csrf}
+var stepReferencePattern = regexp.MustCompile(`\$\{([A-Za-z0-9_.-]+)\}`)
+
+// runLoginChain executes the login steps in order and returns the token produced by the final step
+// Values extracted in one step can be referenced as ${name} in the credential data of later steps,
+// which covers the request body, header parameters and path parameters of those steps
+func (h *AuthHandler) runLoginChain(ctx context.Context, credentials *CredentialsType) (string, error) {
+	values := make(map[string]string)
+	var resp *authResponse
+
+	for i, step := range credentials.LoginSteps {
+		stepName := step.Name
+		if stepName == "" {
+			stepName = fmt.Sprintf("#%d", i+1)
+		}
+
+		// Step values override the shared credential data with the same key
+		// Templates are evaluated before the references, so extracted values are never evaluated as templates
+		credentialData, err := ResolveCredentialTemplates(mergeCredentialData(credentials.CredentialData, step.CredentialData))
+		if err != nil {
+			return "", fmt.Errorf("login step %s: %w", stepName, err)
+		}
+		credentialData, err = resolveStepCredentialData(credentialData, values)
+		if err != nil {
+			return "", fmt.Errorf("login step %s: %w", stepName, err)
+		}
+
+		// Execute the step
+		switch {
+		case step.Endpoint.EndpointType != nil:
+			resp, err = h.executeRESTEndpoint(ctx, step.Endpoint.EndpointType, credentialData)
+		case step.Endpoint.GqlOperationType != nil:
+			resp, err = h.executeGraphQLEndpoint(ctx, step.Endpoint.GqlOperationType, credentialData)
+		default:
+			err = fmt.Errorf("invalid endpoint configuration")
+		}
+		if err != nil {
+			return "", fmt.Errorf("login step %s: %w", stepName, err)
+		}
+
+		// Extract values for the following steps
+		for _, extract := range step.Extract {
+			value, err := extractStepValue(resp, extract)
+			if err != nil {
+				return "", &TokenExtractionError{Err: fmt.Errorf("login step %s: failed to extract '%s': %w", stepName, extract.Name, err)}
+			}
+			values[extract.Name] = value
+		}
+	}
+
+	// The final step's response provides the token
+	token, err := ExtractTokenFromResponse(resp.Body, credentials.TokenLocation)
+	if err != nil {
+		return "", &TokenExtractionError{Err: fmt.Errorf("failed to extract token from final login step: %w", err)}
+	}
+
+	return token, nil
+}
+
+// extractStepValue extracts a value from a login step response by body path, header or cookie
+func extractStepValue(resp *authResponse, extract StepExtractType) (string, error) {
+	switch extract.Source {
+	case "", "body":
+		return ExtractTokenFromResponse(resp.Body, extract.Location)
+
+	case "header":
+		value := resp.Header.Get(extract.Location)
+		if value == "" {
+			return "", fmt.Errorf("header '%s' not found in response", extract.Location)
+		}
+		return value, nil
+
+	case "cookie":
+		for _, cookie := range resp.Cookies {
+			if cookie.Name == extract.Location {
+				return cookie.Value, nil
+			}
+		}
+		return "", fmt.Errorf("cookie '%s' not found in response", extract.Location)
+
+	default:
+		return "", fmt.Errorf("unsupported extract source: %s", extract.Source)
+	}
+}
+
+// mergeCredentialData returns the base credential data with the overrides applied
+func mergeCredentialData(base []CredentialsPairType, overrides []CredentialsPairType) []CredentialsPairType {
+	merged := make([]CredentialsPairType, 0, len(base)+len(overrides))
+	for _, pair := range base {
+		if findCredentialIndex(overrides, pair.Key) < 0 {
+			merged = append(merged, pair)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+// resolveStepCredentialData replaces ${name} references with values extracted by earlier steps
+func resolveStepCredentialData(credentialData []CredentialsPairType, values map[string]string) ([]CredentialsPairType, error) {
+	resolved := make([]CredentialsPairType, len(credentialData))
+
+	for i, pair := range credentialData {
+		var missing string
+		pair.Value = stepReferencePattern.ReplaceAllStringFunc(pair.Value, func(ref string) string {
+			name := stepReferencePattern.FindStringSubmatch(ref)[1]
+			value, ok := values[name]
+			if !ok && missing == "" {
+				missing = name
+			}
+			return value
+		})
+		if missing != "" {
+			return nil, fmt.Errorf("'%s' references unknown value '%s'", pair.Key, missing)
+		}
+		resolved[i] = pair
+	}
+
+	return resolved, nil
+}
+
+// findCredentialIndex returns the index of the credential pair with the given key, or -1
+func findCredentialIndex(credentialData []CredentialsPairType, key string) int {
+	for i, pair := range credentialData {
+		if pair.Key == key {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,246 @@
+package traefik_token_injector
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are written in the Prometheus text format without a client library, so they work under Yaegi
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	graphqlFetchDuration = newHistogramVec("token_injector_graphql_fetch_duration_seconds",
+		"Latency of requests to the GraphQL API.", latencyBuckets)
+	graphqlFetchErrors = newCounterVec("token_injector_graphql_fetch_errors_total",
+		"Failed requests to the GraphQL API by reason.", "reason")
+	loginAttempts = newCounterVec("token_injector_login_attempts_total",
+		"Attempts to obtain a token from authentication endpoints.", "auth_type", "service", "result")
+	loginDuration = newHistogramVec("token_injector_login_duration_seconds",
+		"Latency of obtaining a token from authentication endpoints.", latencyBuckets, "auth_type", "service")
+	injectedRequests = newCounterVec("token_injector_injected_requests_total",
+		"Requests forwarded with an injected authentication token.", "auth_type", "service")
+	degradedRequests = newCounterVec("token_injector_degraded_requests_total",
+		"Requests forwarded by a degradation policy while the control plane or an authentication endpoint was unavailable.", "middleware", "policy", "problem")
+)
+
+// labelSeparator joins label values into map keys, it cannot occur in valid UTF-8
+const labelSeparator = "\xff"
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newCounterVec creates a counter vector
+func newCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc increments the counter of the label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, labelSeparator)]++
+}
+
+// write writes the counters in the text format
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitLabelKey(key)), formatFloat(c.values[key]))
+	}
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// histogram holds the cumulative bucket counts of observations
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogramVec creates a histogram vector with the given bucket upper bounds
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// Observe records an observation for the label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, labelSeparator)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// write writes the histograms in the text format
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+		values := splitLabelKey(key)
+
+		bucketLabels := append(append([]string{}, h.labels...), "le")
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, append(append([]string{}, values...), formatFloat(bound))), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, append(append([]string{}, values...), "+Inf")), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), hist.count)
+	}
+}
+
+// WriteMetrics writes all metrics of the process in the Prometheus text format
+// Cache counters and token expiry timestamps are collected from the registered middlewares
+func WriteMetrics(w io.Writer) {
+	graphqlFetchDuration.write(w)
+	graphqlFetchErrors.write(w)
+	loginAttempts.write(w)
+	loginDuration.write(w)
+	injectedRequests.write(w)
+	degradedRequests.write(w)
+
+	injectors := registeredInjectors()
+
+	cacheCounters := []struct {
+		name  string
+		help  string
+		value func(CacheStats) uint64
+	}{
+		{"token_injector_cache_hits_total", "Token cache lookups served from the cache.", func(s CacheStats) uint64 { return s.Hits }},
+		{"token_injector_cache_misses_total", "Token cache lookups finding no valid token.", func(s CacheStats) uint64 { return s.Misses }},
+		{"token_injector_cache_refreshes_total", "Token cache lookups finding a token due for refresh.", func(s CacheStats) uint64 { return s.Refreshes }},
+		{"token_injector_cache_evictions_total", "Tokens evicted from the cache because it was full or they expired.", func(s CacheStats) uint64 { return s.Evictions }},
+	}
+	stats := make([]CacheStats, len(injectors))
+	for i, injector := range injectors {
+		stats[i] = injector.cache.Stats()
+	}
+	for _, counter := range cacheCounters {
+		writeMetricHeader(w, counter.name, counter.help, "counter")
+		for i, injector := range injectors {
+			fmt.Fprintf(w, "%s%s %d\n", counter.name, formatLabels([]string{"middleware"}, []string{injector.name}), counter.value(stats[i]))
+		}
+	}
+
+	writeMetricHeader(w, "token_injector_cache_entries", "Tokens currently cached.", "gauge")
+	for i, injector := range injectors {
+		fmt.Fprintf(w, "token_injector_cache_entries%s %d\n", formatLabels([]string{"middleware"}, []string{injector.name}), stats[i].Entries)
+	}
+
+	// Report the latest expiry of the tokens of each service, tokens without TTL have no expiry
+	writeMetricHeader(w, "token_injector_token_expiry_timestamp_seconds", "Unix time the cached token of a service expires.", "gauge")
+	for _, injector := range injectors {
+		expiries := make(map[string]float64)
+		for _, cached := range injector.cache.Entries("") {
+			if cached.ExpiresAt != nil && float64(*cached.ExpiresAt) > expiries[cached.ServiceId] {
+				expiries[cached.ServiceId] = float64(*cached.ExpiresAt)
+			}
+		}
+		for _, serviceId := range sortedKeys(expiries) {
+			fmt.Fprintf(w, "token_injector_token_expiry_timestamp_seconds%s %s\n",
+				formatLabels([]string{"middleware", "service"}, []string{injector.name, serviceId}), formatFloat(expiries[serviceId]))
+		}
+	}
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric
+func writeMetricHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// formatLabels formats label pairs as {name="value",...}
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + escapeLabelValue(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabelValue escapes backslashes, quotes and newlines in label values
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// splitLabelKey splits a map key into label values
+func splitLabelKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, labelSeparator)
+}
+
+// formatFloat formats a sample value
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// sortedKeys returns the keys of a map of samples in order
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
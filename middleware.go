@@ -2,9 +2,10 @@ package traefik_token_injector
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"time"
 )
 
 // TokenInjector is the main middleware struct
@@ -16,6 +17,15 @@ type TokenInjector struct {
 	gqlClient    *GraphQLClient
 	authHandler  *AuthHandler
 	cache        *TokenCache
+	remoteProxy  http.Handler
+	selector     *InstanceSelector
+	index        *InstanceIndex
+	admin        *AdminHandler
+	lastErrors   *ServiceErrors
+	tracer       *Tracer
+	logger       *Logger
+	stale        *StaleTokens
+	readiness    *Readiness
 }
 
 // New creates a new TokenInjector middleware instance
@@ -36,21 +46,76 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		return nil, fmt.Errorf("invalid global configuration: %w", err)
 	}
 
+	// Every middleware of the process shares the logging settings of the global configuration
+	ConfigureLogging(globalConfig.Logging)
+	ConfigureTemplates(globalConfig)
+	logger := rootLogger.With("name", name)
+
 	// Create GraphQL client
 	gqlClient, err := NewGraphQLClient(globalConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GraphQL client: %w", err)
 	}
 
-	// Create token cache
-	cache := NewTokenCache()
+	// Create token cache, the janitor runs until the middleware is stopped
+	cache := NewTokenCache(globalConfig.CacheMaxEntries)
+	janitorInterval, _ := globalConfig.GetCacheJanitorInterval()
+	cache.StartJanitor(janitorInterval)
+	go func() {
+		<-ctx.Done()
+		cache.Stop()
+	}()
+
+	// Share tokens with the other replicas through the token store
+	if globalConfig.TokenStore == "redis" {
+		key, err := LoadCacheKey(globalConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cache key: %w", err)
+		}
+		store, err := NewRedisTokenStore(globalConfig, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create token store: %w", err)
+		}
+		lockTtl, _ := globalConfig.GetTokenStoreLockTtl()
+		cache.UseStore(store, lockTtl)
+
+		go func() {
+			<-ctx.Done()
+			store.Close()
+		}()
+		logger.Info("Sharing tokens through redis", "address", globalConfig.RedisAddress)
+	}
+
+	// Restore tokens of the previous run from the encrypted token file of this middleware
+	if globalConfig.CacheDir != "" {
+		key, err := LoadCacheKey(globalConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cache key: %w", err)
+		}
+		file, err := NewTokenFile(TokenFilePath(globalConfig.CacheDir, name), key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open token file: %w", err)
+		}
+		restored, err := cache.PersistTo(file)
+		if err != nil {
+			logger.Warn("Failed to restore token cache, starting empty", "error", err)
+		} else {
+			logger.Info("Restored cached tokens", "count", restored)
+		}
+	}
 
 	// Create auth handler
 	authHandler := NewAuthHandler(cache, globalConfig)
 
-	log.Printf("[TokenInjector] Initialized for service ID: %s", config.ServiceId)
+	// Write obtained tokens back to the control plane in the background
+	if globalConfig.TokenWriteBack != nil {
+		writeBack := NewTokenWriteBack(gqlClient, globalConfig.TokenWriteBack)
+		writeBack.Start(ctx)
+		authHandler.UseWriteBack(writeBack)
+		logger.Info("Writing obtained tokens back", "mutation", globalConfig.TokenWriteBack.Mutation)
+	}
 
-	return &TokenInjector{
+	injector := &TokenInjector{
 		next:         next,
 		name:         name,
 		config:       config,
@@ -58,35 +123,231 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		gqlClient:    gqlClient,
 		authHandler:  authHandler,
 		cache:        cache,
-	}, nil
+		lastErrors:   NewServiceErrors(),
+		logger:       logger,
+		readiness:    NewReadiness(),
+	}
+
+	// Remember the last known good instance and token of each service to serve while the control plane or login is down
+	if config.Degradation.GetPolicy() != DegradationFailClosed {
+		injector.stale = NewStaleTokens()
+	}
+
+	// Requests are proxied to the instance remote location instead of the next handler
+	if config.RouteToRemote {
+		timeout, _ := globalConfig.GetTimeout()
+		injector.remoteProxy = newRemoteProxy(timeout)
+	}
+
+	// Instances are served from the index shared by all middlewares of the process
+	if globalConfig.SyncEnabled {
+		syncer, err := AcquireInstanceSyncer(gqlClient, globalConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start instance sync: %w", err)
+		}
+		injector.index = syncer.Index()
+
+		go func() {
+			<-ctx.Done()
+			ReleaseInstanceSyncer(syncer)
+		}()
+	}
+
+	// Export spans of the auth path to the OTLP collector
+	if globalConfig.Tracing != nil {
+		timeout, _ := globalConfig.GetTimeout()
+		injector.tracer, err = NewTracer(globalConfig.Tracing, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tracer: %w", err)
+		}
+		injector.tracer.Start(ctx)
+		logger.Info("Exporting traces", "endpoint", globalConfig.Tracing.Endpoint)
+	}
+
+	// Expose the middleware through the admin API, served on its own listener or under the admin path
+	if globalConfig.Admin != nil {
+		if globalConfig.Admin.Listen != "" {
+			if err := AcquireAdminServer(globalConfig.Admin); err != nil {
+				return nil, fmt.Errorf("failed to start admin API: %w", err)
+			}
+		} else {
+			injector.admin = NewAdminHandler(globalConfig.Admin)
+		}
+		registerInjector(injector)
+
+		go func() {
+			<-ctx.Done()
+			unregisterInjector(injector)
+			if globalConfig.Admin.Listen != "" {
+				ReleaseAdminServer(globalConfig.Admin)
+			}
+		}()
+	}
+
+	// The instance is selected per request instead of a fixed serviceId
+	if config.InstanceSelector != nil {
+		injector.selector, err = NewInstanceSelector(config.InstanceSelector, gqlClient, injector.index, config.PinConditions())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create instance selector: %w", err)
+		}
+		logger.Info("Initialized with instance selector", "source", config.InstanceSelector.Source)
+	} else if config.InstanceLookup != nil {
+		logger.Info("Initialized for instance lookup", "search", describeSearch(config.InstanceLookup.Conditions()))
+	} else {
+		logger.Info("Initialized for service", "serviceId", config.ServiceId)
+	}
+	if config.PinVersionId != "" {
+		logger.Info("Pinned to version", "versionId", config.PinVersionId)
+	}
+
+	// Prefetch the instance and the first token so the first request does not pay for the login
+	if config.Warmup != nil {
+		if err := injector.startWarmup(ctx); err != nil {
+			return nil, fmt.Errorf("warmup failed: %w", err)
+		}
+	}
+
+	return injector, nil
 }
 
 // ServeHTTP implements the http.Handler interface
 func (t *TokenInjector) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Admin requests are handled by the plugin and never forwarded
+	if t.admin != nil && t.admin.Matches(req) {
+		t.admin.ServeHTTP(rw, req)
+		return
+	}
+
+	// Continue the trace of the incoming request, spans are no-ops when tracing is disabled
+	req, span := t.tracer.StartRequest(req, "token_injector")
+	defer span.End()
+	span.SetAttribute("middleware", t.name)
+
 	// Fetch instance data from GraphQL API
-	instance, err := t.gqlClient.FetchInstanceById(t.config.ServiceId)
+	fetchCtx, fetchSpan := StartSpan(req.Context(), "fetch_instance", SpanKindInternal)
+	instance, err := t.fetchInstance(req.WithContext(fetchCtx))
+	fetchSpan.RecordError(err)
+	fetchSpan.End()
+	var stale *staleToken
 	if err != nil {
-		log.Printf("[TokenInjector] Failed to fetch instance data: %v", err)
-		http.Error(rw, "Failed to fetch instance data", http.StatusInternalServerError)
+		span.RecordError(err)
+		t.lastErrors.Record(t.config.ServiceId, err)
+		if t.selector != nil && errors.Is(err, errNoInstance) {
+			t.logger.Info("No instance matches request", "method", req.Method, "path", req.URL.Path, "error", err)
+			http.Error(rw, t.config.InstanceSelector.GetNoMatchMessage(), t.config.InstanceSelector.GetNoMatchStatusCode())
+			return
+		}
+
+		// The request continues with the last known good instance when the policy allows
+		logger := t.logger.With("serviceId", t.config.ServiceId)
+		stale = t.degrade(logger, "", nil, err)
+		if stale == nil {
+			t.readiness.Set(t.readinessKey(""), ReadinessFailed, err)
+			t.fail(rw, req, logger, "Failed to fetch instance data", err)
+			return
+		}
+		instance = stale.instance
+	}
+
+	serviceId := instance.ID
+	if serviceId == "" {
+		serviceId = t.config.ServiceId
+	}
+	span.SetAttribute("service.id", serviceId)
+
+	// Credential values and tokens of the instance are redacted wherever they appear in messages
+	logger := t.logger.With("serviceId", serviceId).WithSecrets(credentialSecrets(instance.Credentials)...)
+
+	// Validate header operations before modifying the request
+	if err := ValidateHeaders(instance.Headers); err != nil {
+		t.fail(rw, req, logger, "Invalid request headers", &HeaderConfigurationError{Err: err})
+		return
+	}
+	if err := ValidateHeaders(instance.ResponseHeaders); err != nil {
+		t.fail(rw, req, logger, "Invalid response headers", &HeaderConfigurationError{Err: err})
 		return
 	}
 
+	// Inspect GraphQL requests to determine the executed operations
+	var gqlInfo *GraphQLRequestInfo
+	if IsGraphQLInstance(instance) {
+		gqlInfo, err = InspectGraphQLRequest(req)
+		if err != nil {
+			logger.Warn("Failed to inspect GraphQL request", "error", err)
+		} else {
+			req = req.WithContext(WithGraphQLRequestInfo(req.Context(), gqlInfo))
+			for _, op := range gqlInfo.Operations {
+				logger.Debug("GraphQL operation", "type", op.Type, "operation", op.Name, "fields", op.Fields)
+			}
+		}
+	}
+
+	// Enforce the instance operation allowlist
+	if t.config.EnforceOperations {
+		allowed, operation := MatchOperation(instance, req, gqlInfo)
+		if !allowed {
+			logger.Audit("Denied operation", "operation", operation, "method", req.Method, "path", req.URL.Path, "remote", req.RemoteAddr)
+			t.deny(rw)
+			return
+		}
+	}
+
 	// Check if credentials are configured
 	if instance.Credentials == nil {
-		log.Printf("[TokenInjector] No credentials configured for service ID: %s", t.config.ServiceId)
+		logger.Debug("No credentials configured")
+		if stale == nil {
+			t.readiness.Set(t.readinessKey(serviceId), ReadinessReady, nil)
+			if t.stale != nil {
+				t.stale.Record(t.staleKey(serviceId), instance, "")
+			}
+		}
 		// No authentication required, pass through
-		t.next.ServeHTTP(rw, req)
+		t.forward(rw, req, instance)
 		return
 	}
 
-	// Get authentication token based on auth type
-	token, err := t.authHandler.GetAuthToken(t.config.ServiceId, instance.Credentials)
-	if err != nil {
-		log.Printf("[TokenInjector] Failed to get auth token: %v", err)
-		http.Error(rw, "Failed to authenticate", http.StatusUnauthorized)
-		return
+	// Get authentication token based on auth type, unless the last known good token is served
+	var token string
+	if stale != nil {
+		token = stale.token
+	} else if token, err = t.authHandler.GetAuthToken(req.Context(), serviceId, instance.Credentials, NewTokenTag(instance)); err != nil {
+		// The error is kept by the admin API, readiness and traces, so credential values are removed first
+		err = logger.RedactError(err)
+		span.RecordError(err)
+		t.lastErrors.Record(serviceId, err)
+
+		authLogger := logger.With("authType", instance.Credentials.AuthType)
+		entry := t.degrade(authLogger, serviceId, instance, err)
+		if entry == nil {
+			t.readiness.Set(t.readinessKey(serviceId), ReadinessFailed, err)
+			t.fail(rw, req, authLogger, "Failed to get auth token", err)
+			return
+		}
+		token = entry.token
+	} else {
+		t.readiness.Set(t.readinessKey(serviceId), ReadinessReady, nil)
+		if t.stale != nil {
+			t.stale.Record(t.staleKey(serviceId), instance, token)
+		}
+	}
+
+	// Request header templates can use values of the incoming request and the raw token
+	tmpl := &TemplateContext{Request: req, Token: token}
+	logger = logger.WithSecrets(token)
+
+	// Response header templates are sent to the client, so they only see the headers the client sent
+	var responseTmpl *TemplateContext
+	if len(instance.ResponseHeaders) > 0 {
+		responseTmpl = &TemplateContext{Request: req.Clone(req.Context()), Response: true}
 	}
 
+	_, injectSpan := StartSpan(req.Context(), "inject_headers", SpanKindInternal)
+	defer injectSpan.End()
+
+	// Strip client headers before injecting credentials so removals never affect the injected token
+	removals, requestHeaders := SplitRemovals(instance.Headers)
+	ApplyHeaders(req.Header, removals)
+
 	// Inject authentication header if token is not empty
 	if token != "" {
 		// Determine the header name based on auth type
@@ -102,17 +363,228 @@ func (t *TokenInjector) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 
 		req.Header.Set(headerName, token)
-		log.Printf("[TokenInjector] Injected %s auth token for service ID: %s", instance.Credentials.AuthType, t.config.ServiceId)
+		injectedRequests.Inc(instance.Credentials.AuthType, serviceId)
+		logger.Debug("Injected auth token", "authType", instance.Credentials.AuthType)
+	}
+
+	// Apply custom header operations from instance configuration
+	if len(requestHeaders) > 0 {
+		headers, err := ResolveHeaders(requestHeaders, tmpl)
+		if err != nil {
+			injectSpan.RecordError(logger.RedactError(err))
+			t.fail(rw, req, logger, "Failed to build request headers", &HeaderConfigurationError{Err: err})
+			return
+		}
+		ApplyHeaders(req.Header, headers)
+		logger.Debug("Added custom headers", "count", len(headers))
+	}
+
+	// Apply response header operations once the upstream response headers are known
+	if len(instance.ResponseHeaders) > 0 {
+		headers, err := ResolveHeaders(instance.ResponseHeaders, responseTmpl)
+		if err != nil {
+			injectSpan.RecordError(logger.RedactError(err))
+			t.fail(rw, req, logger, "Failed to build response headers", &HeaderConfigurationError{Err: err})
+			return
+		}
+		rw = newHeaderRewriteWriter(rw, headers)
+	}
+	injectSpan.End()
+
+	// Forward the request to the next handler or the remote host
+	t.forward(rw, req, instance)
+}
+
+// fetchInstance returns the instance serving the request
+func (t *TokenInjector) fetchInstance(req *http.Request) (*InstanceType, error) {
+	if t.selector != nil {
+		return t.selector.Select(req)
+	}
+	return t.fetchConfiguredInstance(req.Context())
+}
+
+// fetchConfiguredInstance returns the instance configured by the serviceId or the instance lookup
+func (t *TokenInjector) fetchConfiguredInstance(ctx context.Context) (*InstanceType, error) {
+	client := t.gqlClient.WithContext(ctx)
+	if t.config.InstanceLookup != nil || t.config.PinVersionId != "" {
+		conditions := t.lookupConditions()
+		instances, err := findInstances(t.index, client, conditions)
+		if err != nil {
+			return nil, err
+		}
+		return singleInstance(instances, conditions)
+	}
+	if t.index != nil {
+		if instance, ok := t.index.Get(t.config.ServiceId); ok {
+			return instance, nil
+		}
+	}
+	return client.FetchInstanceById(t.config.ServiceId)
+}
+
+// lookupConditions returns the search conditions of the instance served by a lookup or pinned middleware
+func (t *TokenInjector) lookupConditions() []SearchCondition {
+	var conditions []SearchCondition
+	if t.config.InstanceLookup != nil {
+		conditions = t.config.InstanceLookup.Conditions()
+	} else {
+		conditions = []SearchCondition{{Field: "_id", Value: t.config.ServiceId, Kind: "ID", Operator: "EQ"}}
+	}
+	return append(conditions, t.config.PinConditions()...)
+}
+
+// servesService reports whether the middleware serves a service or holds tokens of it
+// Middlewares with an instance lookup resolve their instance, they may not have cached a token yet
+func (t *TokenInjector) servesService(serviceId string) bool {
+	if t.config.ServiceId == serviceId || len(t.cache.Entries(serviceId)) > 0 {
+		return true
+	}
+	if t.config.InstanceLookup == nil {
+		return false
+	}
+	instance, err := t.fetchConfiguredInstance(context.Background())
+	return err == nil && instance.ID == serviceId
+}
+
+// reloadService re-fetches the instance of a service under the pin conditions of the middleware
+// and replaces the copies held by the index and the selector cache
+func (t *TokenInjector) reloadService(serviceId string) (*InstanceType, error) {
+	conditions := append([]SearchCondition{{Field: "_id", Value: serviceId, Kind: "ID", Operator: "EQ"}}, t.config.PinConditions()...)
+	instance, err := t.gqlClient.FetchInstance(conditions)
+	if err != nil {
+		return nil, t.logger.RedactError(err)
+	}
+	t.reloadInstance(instance)
+	return instance, nil
+}
+
+// refreshService evicts the cached tokens of a service and logs in again with the current instance
+func (t *TokenInjector) refreshService(serviceId string) error {
+	instance, err := t.reloadService(serviceId)
+	if err != nil {
+		return err
+	}
+	t.cache.DeleteService(serviceId)
+
+	if instance.Credentials == nil {
+		return nil
+	}
+	_, err = t.authHandler.RefreshAuthToken(context.Background(), serviceId, instance.Credentials, NewTokenTag(instance))
+	if err != nil {
+		err = t.logger.WithSecrets(credentialSecrets(instance.Credentials)...).RedactError(err)
+		t.readiness.Set(t.readinessKey(serviceId), ReadinessFailed, err)
+		return err
+	}
+	t.readiness.Set(t.readinessKey(serviceId), ReadinessReady, nil)
+	return nil
+}
+
+// reloadInstance replaces the copies of an instance held by the index and the selector cache
+func (t *TokenInjector) reloadInstance(instance *InstanceType) {
+	if t.index != nil {
+		t.index.Upsert([]*InstanceType{instance})
+	}
+	if t.selector != nil {
+		t.selector.Invalidate()
+	}
+}
+
+// forward passes the request to the next handler, or to the instance remote location when routing is enabled
+func (t *TokenInjector) forward(rw http.ResponseWriter, req *http.Request, instance *InstanceType) {
+	// The upstream continues the trace of this middleware
+	InjectTraceparent(req.Context(), req.Header)
+
+	if t.remoteProxy == nil {
+		t.next.ServeHTTP(rw, req)
+		return
 	}
 
-	// Add any custom headers from instance configuration
-	if len(instance.Headers) > 0 {
-		for _, header := range instance.Headers {
-			req.Header.Set(header.Key, header.Value)
+	if err := RewriteRequest(req, instance); err != nil {
+		t.lastErrors.Record(instance.ID, err)
+		t.logger.Error("Failed to route request", "serviceId", instance.ID, "error", err)
+		http.Error(rw, "Failed to route request", http.StatusBadGateway)
+		return
+	}
+
+	t.remoteProxy.ServeHTTP(rw, req)
+}
+
+// degrade applies the degradation policy to a request that failed because of err
+// It returns the instance and token the request continues with, or nil when the caller fails the request.
+// Under serveStale these are the last known good instance and token if they are recent enough. Under passThrough
+// the token is empty; the instance is needed for its header removals and operation allowlist, so while the
+// control plane is down the last known good instance is used. serviceId is empty when the instance could not be fetched.
+func (t *TokenInjector) degrade(logger *Logger, serviceId string, instance *InstanceType, err error) *staleToken {
+	policy := t.config.Degradation.GetPolicy()
+	problemType := ClassifyError(err)
+	if policy == DegradationFailClosed || !degradable(problemType) {
+		return nil
+	}
+
+	maxAge, _ := t.config.Degradation.GetStaleMaxAge()
+	entry, ok := t.stale.Get(t.staleKey(serviceId), maxAge)
+
+	switch policy {
+	case DegradationPassThrough:
+		if instance == nil {
+			if !ok {
+				return nil
+			}
+			instance = entry.instance
+		}
+		logger.Warn("Forwarding request without credentials", "policy", policy, "problem", problemType, "error", err)
+		degradedRequests.Inc(t.name, policy, problemType)
+		t.readiness.Set(t.readinessKey(serviceId), ReadinessDegraded, err)
+		return &staleToken{instance: instance}
+	case DegradationServeStale:
+		if !ok {
+			return nil
 		}
-		log.Printf("[TokenInjector] Added %d custom headers", len(instance.Headers))
+		logger.Warn("Forwarding request with stale token", "policy", policy, "problem", problemType,
+			"age", time.Since(entry.recordedAt).Round(time.Second).String(), "error", err)
+		degradedRequests.Inc(t.name, policy, problemType)
+		t.readiness.Set(t.readinessKey(serviceId), ReadinessDegraded, err)
+		return &entry
 	}
+	return nil
+}
+
+// staleKey returns the key of the last known good token of a service
+// A middleware without instance selector serves a single instance, so it is found even when the instance cannot be fetched
+func (t *TokenInjector) staleKey(serviceId string) string {
+	if t.selector == nil {
+		return ""
+	}
+	return serviceId
+}
 
-	// Forward the request to the next handler
-	t.next.ServeHTTP(rw, req)
+// readinessKey returns the key the readiness of a service is reported under
+// A middleware without instance selector reports its configured service, even before the instance was fetched
+func (t *TokenInjector) readinessKey(serviceId string) string {
+	if t.selector != nil {
+		return serviceId
+	}
+	if t.config.ServiceId != "" {
+		return t.config.ServiceId
+	}
+	return describeSearch(t.lookupConditions())
+}
+
+// fail logs the failure of a request and writes the problem details of its error type
+// The correlation ID connects the response to the log message
+func (t *TokenInjector) fail(rw http.ResponseWriter, req *http.Request, logger *Logger, msg string, err error) {
+	problemType := ClassifyError(err)
+	problem := newProblem(t.config.ErrorResponses, problemType, correlationId(req, t.config.ErrorResponses))
+
+	logger.Error(msg, "problem", problemType, "status", problem.Status, "correlationId", problem.CorrelationId, "error", err)
+	writeProblem(rw, t.config.ErrorResponses, problem)
+}
+
+// deny writes the configured response for requests that do not match an allowed operation
+func (t *TokenInjector) deny(rw http.ResponseWriter) {
+	statusCode := t.config.DenyStatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusForbidden
+	}
+	http.Error(rw, t.config.DenyMessage, statusCode)
 }
@@ -0,0 +1,132 @@
+package traefik_token_injector
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// IsGraphQLInstance reports whether the instance fronts a GraphQL API
+func IsGraphQLInstance(instance *InstanceType) bool {
+	return strings.EqualFold(instance.Type, "GRAPHQL")
+}
+
+// MatchOperation checks whether the request matches one of the operations allowed by the instance
+// For GraphQL instances the operations parsed by InspectGraphQLRequest are matched, a nil info is denied
+// It returns the description of the requested operation, used for audit logging
+func MatchOperation(instance *InstanceType, req *http.Request, info *GraphQLRequestInfo) (bool, string) {
+	if IsGraphQLInstance(instance) {
+		return matchGraphQLOperation(instance, info)
+	}
+	return matchRESTOperation(instance, req)
+}
+
+// matchRESTOperation matches the request method and path against the allowed operations
+// Operations have the form "METHOD /path/{param}", the method can be omitted or "*" to allow any method
+func matchRESTOperation(instance *InstanceType, req *http.Request) (bool, string) {
+	path := relativeServicePath(req.URL.Path, instance.ServicePath)
+	requested := req.Method + " " + path
+
+	for _, operation := range instance.Operations {
+		method, template := "*", strings.TrimSpace(operation)
+		if i := strings.IndexByte(template, ' '); i >= 0 {
+			method, template = template[:i], strings.TrimSpace(template[i+1:])
+		}
+
+		if method != "*" && !strings.EqualFold(method, req.Method) {
+			continue
+		}
+		if matchPathTemplate(template, path) {
+			return true, requested
+		}
+	}
+
+	return false, requested
+}
+
+// relativeServicePath strips the instance service path from a request path
+func relativeServicePath(path string, servicePath string) string {
+	servicePath = strings.TrimRight(servicePath, "/")
+	if servicePath != "" && (path == servicePath || strings.HasPrefix(path, servicePath+"/")) {
+		path = strings.TrimPrefix(path, servicePath)
+	}
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// matchPathTemplate matches a path against a template where {param} matches a single segment
+// A {param} never matches a "." or ".." segment, so a parameter cannot be used to traverse the path
+func matchPathTemplate(template string, path string) bool {
+	templateParts := strings.Split(strings.Trim(template, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+
+	if len(templateParts) != len(pathParts) {
+		return false
+	}
+
+	for i, part := range templateParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			if pathParts[i] == "" || isDotSegment(pathParts[i]) {
+				return false
+			}
+			continue
+		}
+		if part != pathParts[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isDotSegment reports whether a path segment is "." or "..", including percent-encoded forms like "%2e%2e"
+func isDotSegment(segment string) bool {
+	if unescaped, err := url.PathUnescape(segment); err == nil {
+		segment = unescaped
+	}
+	return segment == "." || segment == ".."
+}
+
+// matchGraphQLOperation matches the GraphQL operations of the request against the allowed operations
+// Operations have the form "type name" (e.g. "query getUsers") or just the operation name
+// Batched requests are only allowed if every operation in the batch is allowed
+func matchGraphQLOperation(instance *InstanceType, info *GraphQLRequestInfo) (bool, string) {
+	if info == nil || len(info.Operations) == 0 {
+		return false, ""
+	}
+
+	requested := make([]string, len(info.Operations))
+	allowed := true
+	for i, op := range info.Operations {
+		requested[i] = strings.TrimSpace(op.Type + " " + op.Name)
+		if !graphQLOperationAllowed(instance.Operations, op) {
+			allowed = false
+		}
+	}
+
+	return allowed, strings.Join(requested, ", ")
+}
+
+// graphQLOperationAllowed reports whether a single GraphQL operation is in the allowlist
+func graphQLOperationAllowed(operations []string, op GraphQLOperation) bool {
+	if op.Name == "" {
+		return false
+	}
+
+	for _, operation := range operations {
+		fields := strings.Fields(operation)
+		switch len(fields) {
+		case 1:
+			if fields[0] == op.Name {
+				return true
+			}
+		case 2:
+			if strings.EqualFold(fields[0], op.Type) && fields[1] == op.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
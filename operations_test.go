@@ -0,0 +1,102 @@
+package traefik_token_injector
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchPathTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		want     bool
+	}{
+		{template: "/users", path: "/users", want: true},
+		{template: "/users", path: "/users/", want: true},
+		{template: "/users", path: "/accounts", want: false},
+		{template: "/users/{id}", path: "/users/42", want: true},
+		{template: "/users/{id}", path: "/users", want: false},
+		{template: "/users/{id}", path: "/users/42/roles", want: false},
+		{template: "/users/{id}/roles", path: "/users/42/roles", want: true},
+		{template: "/users/{id}/roles", path: "/users//roles", want: false},
+		{template: "/users/{id}", path: "/users/a..b", want: true},
+		{template: "/users/{id}", path: "/users/..", want: false},
+		{template: "/users/{id}", path: "/users/.", want: false},
+		{template: "/users/{id}", path: "/users/%2e%2e", want: false},
+		{template: "/users/{id}", path: "/users/%2E.", want: false},
+		{template: "/users/{id}/roles", path: "/users/../roles", want: false},
+		{template: "/", path: "/", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := matchPathTemplate(tt.template, tt.path); got != tt.want {
+			t.Errorf("matchPathTemplate(%q, %q) = %v, want %v", tt.template, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMatchRESTOperation(t *testing.T) {
+	instance := &InstanceType{
+		ServicePath: "/api/",
+		Operations:  []string{"GET /users/{id}", "* /health", "/status", "post /users"},
+	}
+
+	tests := []struct {
+		method    string
+		target    string
+		want      bool
+		requested string
+	}{
+		{method: "GET", target: "/api/users/42", want: true, requested: "GET /users/42"},
+		{method: "DELETE", target: "/api/users/42", want: false, requested: "DELETE /users/42"},
+		{method: "POST", target: "/api/users", want: true, requested: "POST /users"},
+		{method: "PUT", target: "/api/health", want: true, requested: "PUT /health"},
+		{method: "PATCH", target: "/api/status", want: true, requested: "PATCH /status"},
+		{method: "GET", target: "/api", want: false, requested: "GET /"},
+		{method: "GET", target: "/api/users/%2e%2e", want: false, requested: "GET /users/.."},
+		{method: "GET", target: "/apiusers/42", want: false, requested: "GET /apiusers/42"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		allowed, requested := MatchOperation(instance, req, nil)
+		if allowed != tt.want || requested != tt.requested {
+			t.Errorf("%s %s = %v, %q, want %v, %q", tt.method, tt.target, allowed, requested, tt.want, tt.requested)
+		}
+	}
+}
+
+func TestMatchGraphQLOperation(t *testing.T) {
+	instance := &InstanceType{
+		Type:       "graphql",
+		Operations: []string{"query getUsers", "createUser"},
+	}
+
+	tests := []struct {
+		name       string
+		operations []GraphQLOperation
+		want       bool
+		requested  string
+	}{
+		{name: "typed operation", operations: []GraphQLOperation{{Type: "query", Name: "getUsers"}}, want: true, requested: "query getUsers"},
+		{name: "wrong type", operations: []GraphQLOperation{{Type: "mutation", Name: "getUsers"}}, want: false, requested: "mutation getUsers"},
+		{name: "name only", operations: []GraphQLOperation{{Type: "mutation", Name: "createUser"}}, want: true, requested: "mutation createUser"},
+		{name: "anonymous operation", operations: []GraphQLOperation{{Type: "query"}}, want: false, requested: "query"},
+		{name: "allowed batch", operations: []GraphQLOperation{{Type: "query", Name: "getUsers"}, {Type: "mutation", Name: "createUser"}}, want: true, requested: "query getUsers, mutation createUser"},
+		{name: "batch with a denied operation", operations: []GraphQLOperation{{Type: "query", Name: "getUsers"}, {Type: "mutation", Name: "deleteUser"}}, want: false, requested: "query getUsers, mutation deleteUser"},
+	}
+
+	req := httptest.NewRequest("POST", "/graphql", nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, requested := MatchOperation(instance, req, &GraphQLRequestInfo{Operations: tt.operations})
+			if allowed != tt.want || requested != tt.requested {
+				t.Errorf("got %v, %q, want %v, %q", allowed, requested, tt.want, tt.requested)
+			}
+		})
+	}
+
+	if allowed, _ := MatchOperation(instance, req, nil); allowed {
+		t.Error("a request without parsed operations was allowed")
+	}
+}
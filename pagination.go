@@ -0,0 +1,54 @@
+package traefik_token_injector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// errPageLimit is returned when a connection has more pages than the iterator may walk
+var errPageLimit = errors.New("page limit reached")
+
+// PageFetcher fetches the page of a connection starting after the given cursor
+// An empty cursor fetches the first page
+type PageFetcher func(first int, after string) (*PageInfo, error)
+
+// PageIterator walks every page of a Relay-style connection
+type PageIterator struct {
+	PageSize int // Number of items requested per page
+	MaxPages int // Upper bound on the number of pages, 0 means unbounded
+}
+
+// Walk calls fetch for every page of the connection until the last page
+// It fails with errPageLimit instead of silently dropping results when MaxPages is exceeded
+func (it PageIterator) Walk(fetch PageFetcher) error {
+	after := ""
+
+	for page := 1; ; page++ {
+		pageInfo, err := fetch(it.PageSize, after)
+		if err != nil {
+			return err
+		}
+
+		if pageInfo == nil || !pageInfo.HasNextPage {
+			return nil
+		}
+		if pageInfo.EndCursor == "" || pageInfo.EndCursor == after {
+			return fmt.Errorf("connection reported a next page without advancing the cursor")
+		}
+		if it.MaxPages > 0 && page >= it.MaxPages {
+			return fmt.Errorf("%w: more than %d pages of %d items", errPageLimit, it.MaxPages, it.PageSize)
+		}
+		after = pageInfo.EndCursor
+	}
+}
+
+// buildPaginationArguments builds the first/after arguments of a connection field
+func buildPaginationArguments(first int, after string) string {
+	args := fmt.Sprintf("first: %d", first)
+	if after != "" {
+		cursor, _ := json.Marshal(after)
+		args += fmt.Sprintf(", after: %s", cursor)
+	}
+	return args
+}
@@ -4,14 +4,82 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 )
 
+// CredentialResolveOptions controls how TOTP codes in credential data are generated
+type CredentialResolveOptions struct {
+	Time       time.Time // Time used to generate TOTP codes, defaults to now
+	TotpWindow int       // Offset in TOTP periods to compensate for clock skew
+}
+
+// ResolveCredentialData returns a copy of the credential data with TOTP codes generated
+// Pairs that are already resolved are returned unchanged
+func ResolveCredentialData(credentialData []CredentialsPairType, opts CredentialResolveOptions) ([]CredentialsPairType, error) {
+	at := opts.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	resolved := make([]CredentialsPairType, len(credentialData))
+	for i, pair := range credentialData {
+		if pair.Totp != nil {
+			offset := time.Duration(opts.TotpWindow*pair.Totp.GetPeriod()) * time.Second
+			code, err := GenerateTOTP(pair.Totp, at.Add(offset))
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate totp code for key '%s': %w", pair.Key, err)
+			}
+			pair.Value = code
+			pair.Totp = nil
+		}
+		resolved[i] = pair
+	}
+
+	return resolved, nil
+}
+
+// ResolveCredentialTemplates returns a copy of the credential data with the {{ ... }} templates of the pairs
+// marked as templates evaluated, other values are used literally
+// Templates are evaluated without the incoming request: a token is shared by every request of a service,
+// so it must not depend on the request that triggered the login
+func ResolveCredentialTemplates(credentialData []CredentialsPairType) ([]CredentialsPairType, error) {
+	resolved := make([]CredentialsPairType, len(credentialData))
+	for i, pair := range credentialData {
+		if pair.Template && pair.Totp == nil {
+			value, err := EvaluateTemplate(pair.Value, &TemplateContext{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate value for key '%s': %w", pair.Key, err)
+			}
+			pair.Value = value
+		}
+		resolved[i] = pair
+	}
+
+	return resolved, nil
+}
+
+// hasTotpCredential reports whether any credential pair generates a TOTP code
+func hasTotpCredential(credentialData []CredentialsPairType) bool {
+	for _, pair := range credentialData {
+		if pair.Totp != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // BuildNestedObject creates a nested JSON object from credential data pairs
 // Example: [{key: "user.name", value: "john"}, {key: "user.pass", value: "secret"}]
 // Returns: {"user": {"name": "john", "pass": "secret"}}
 func BuildNestedObject(credentialData []CredentialsPairType) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
 
+	// Generate dynamic values such as TOTP codes
+	credentialData, err := ResolveCredentialData(credentialData, CredentialResolveOptions{})
+	if err != nil {
+		return nil, err
+	}
+
 	for _, pair := range credentialData {
 		if err := setNestedValue(result, pair.Key, pair.Value); err != nil {
 			return nil, fmt.Errorf("failed to set nested value for key '%s': %w", pair.Key, err)
@@ -68,6 +136,12 @@ func BuildRESTRequest(endpoint *EndpointType, credentialData []CredentialsPairTy
 	url = baseURL + endpoint.Path
 	headers = make(map[string]string)
 
+	// Generate dynamic values such as TOTP codes
+	credentialData, err = ResolveCredentialData(credentialData, CredentialResolveOptions{})
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+
 	// Build request body if needed
 	if endpoint.RequestBody != nil && endpoint.RequestBody.Required {
 		// Build nested object from credential data
@@ -0,0 +1,89 @@
+package traefik_token_injector
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RewriteRequest rewrites the request to the remote location of the instance
+// The instance service_path is stripped from the request path, the remote_path is prepended
+// and the URL and Host are set to the remote_host (https is assumed when no scheme is given)
+func RewriteRequest(req *http.Request, instance *InstanceType) error {
+	target, err := parseRemoteHost(instance.RemoteHost)
+	if err != nil {
+		return err
+	}
+
+	// Build the upstream path, keeping the escaped form of the request path
+	relPath := relativeServicePath(req.URL.Path, instance.ServicePath)
+	relRawPath := relativeServicePath(req.URL.EscapedPath(), instance.ServicePath)
+
+	remotePath := strings.TrimRight(instance.RemotePath, "/")
+	if remotePath != "" && !strings.HasPrefix(remotePath, "/") {
+		remotePath = "/" + remotePath
+	}
+
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path = remotePath + relPath
+	req.URL.RawPath = ""
+	if rawPath := remotePath + relRawPath; rawPath != req.URL.Path {
+		req.URL.RawPath = rawPath
+	}
+	req.Host = target.Host
+
+	return nil
+}
+
+// parseRemoteHost parses an instance remote_host into a scheme and host
+func parseRemoteHost(remoteHost string) (*url.URL, error) {
+	if remoteHost == "" {
+		return nil, fmt.Errorf("instance has no remote_host")
+	}
+	if !strings.Contains(remoteHost, "://") {
+		remoteHost = "https://" + remoteHost
+	}
+
+	target, err := url.Parse(remoteHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote_host '%s': %w", remoteHost, err)
+	}
+	if target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil, fmt.Errorf("invalid remote_host '%s'", remoteHost)
+	}
+
+	return target, nil
+}
+
+// newRemoteProxy creates a reverse proxy that forwards already rewritten requests
+// Connecting, the TLS handshake and waiting for the response headers are each bounded by timeout,
+// the response body is streamed without a deadline
+func newRemoteProxy(timeout time.Duration) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		// The request URL is rewritten by RewriteRequest before it reaches the proxy
+		Director: func(req *http.Request) {},
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+			ForceAttemptHTTP2:     true,
+		},
+		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+			rootLogger.Error("Failed to proxy request", "host", req.URL.Host, "error", err)
+			if isTimeout(err) {
+				http.Error(rw, "Remote host timed out", http.StatusGatewayTimeout)
+				return
+			}
+			http.Error(rw, "Failed to reach remote host", http.StatusBadGateway)
+		},
+	}
+}
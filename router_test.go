@@ -0,0 +1,196 @@
+package traefik_token_injector
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRewriteRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		instance *InstanceType
+		url      string
+		host     string
+	}{
+		{
+			name:     "https is assumed",
+			target:   "/users/42",
+			instance: &InstanceType{RemoteHost: "api.example.com"},
+			url:      "https://api.example.com/users/42",
+			host:     "api.example.com",
+		},
+		{
+			name:     "service path is stripped and remote path prepended",
+			target:   "/svc/users/42?page=2",
+			instance: &InstanceType{ServicePath: "/svc", RemoteHost: "http://backend:8080", RemotePath: "/v2/"},
+			url:      "http://backend:8080/v2/users/42?page=2",
+			host:     "backend:8080",
+		},
+		{
+			name:     "remote path without leading slash",
+			target:   "/svc",
+			instance: &InstanceType{ServicePath: "/svc/", RemoteHost: "http://backend", RemotePath: "v2"},
+			url:      "http://backend/v2/",
+			host:     "backend",
+		},
+		{
+			name:     "path sharing the service path prefix is kept",
+			target:   "/svcx/users",
+			instance: &InstanceType{ServicePath: "/svc", RemoteHost: "http://backend"},
+			url:      "http://backend/svcx/users",
+			host:     "backend",
+		},
+		{
+			name:     "escaped path is preserved",
+			target:   "/svc/files/a%2Fb",
+			instance: &InstanceType{ServicePath: "/svc", RemoteHost: "http://backend", RemotePath: "/store"},
+			url:      "http://backend/store/files/a%2Fb",
+			host:     "backend",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if err := RewriteRequest(req, tt.instance); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := req.URL.String(); got != tt.url {
+				t.Errorf("URL = %q, want %q", got, tt.url)
+			}
+			if req.Host != tt.host {
+				t.Errorf("Host = %q, want %q", req.Host, tt.host)
+			}
+		})
+	}
+}
+
+func TestRewriteRequestInvalidRemoteHost(t *testing.T) {
+	for _, remoteHost := range []string{"", "ftp://backend", "http://", "http://[::1"} {
+		req := httptest.NewRequest("GET", "/users", nil)
+		if err := RewriteRequest(req, &InstanceType{RemoteHost: remoteHost}); err == nil {
+			t.Errorf("remote_host %q was accepted", remoteHost)
+		}
+	}
+}
+
+func TestRemoteProxy(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req
+		rw.Header().Set("X-Upstream", "yes")
+		rw.WriteHeader(http.StatusCreated)
+		io.WriteString(rw, "created")
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest("POST", "http://traefik.local/svc/files/a%2Fb?x=1", nil)
+	req.Header.Set("Authorization", "Bearer injected")
+	instance := &InstanceType{ServicePath: "/svc", RemoteHost: upstream.URL, RemotePath: "/v2"}
+	if err := RewriteRequest(req, instance); err != nil {
+		t.Fatalf("RewriteRequest: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	newRemoteProxy(time.Second).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated || rec.Body.String() != "created" || rec.Header().Get("X-Upstream") != "yes" {
+		t.Errorf("response = %d %q, want the upstream response", rec.Code, rec.Body.String())
+	}
+	if received == nil {
+		t.Fatal("the upstream received no request")
+	}
+	if received.RequestURI != "/v2/files/a%2Fb?x=1" {
+		t.Errorf("upstream request URI = %q, want /v2/files/a%%2Fb?x=1", received.RequestURI)
+	}
+	if received.Host != upstream.Listener.Addr().String() {
+		t.Errorf("upstream Host = %q, want the remote host", received.Host)
+	}
+	if received.Header.Get("Authorization") != "Bearer injected" {
+		t.Error("the injected header was not forwarded")
+	}
+}
+
+func TestRemoteProxyErrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		remote string
+		status int
+	}{
+		{name: "response headers time out", remote: slow.URL, status: http.StatusGatewayTimeout},
+		{name: "remote host unreachable", remote: closed.URL, status: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/users", nil)
+			if err := RewriteRequest(req, &InstanceType{RemoteHost: tt.remote}); err != nil {
+				t.Fatalf("RewriteRequest: %v", err)
+			}
+
+			rec := httptest.NewRecorder()
+			newRemoteProxy(100*time.Millisecond).ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestForward(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "remote "+req.URL.Path)
+	}))
+	defer upstream.Close()
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "next "+req.URL.Path)
+	})
+
+	tests := []struct {
+		name     string
+		routed   bool
+		instance *InstanceType
+		status   int
+		body     string
+	}{
+		{name: "next handler", instance: &InstanceType{RemoteHost: upstream.URL, RemotePath: "/v2"}, status: http.StatusOK, body: "next /svc/users"},
+		{name: "remote host", routed: true, instance: &InstanceType{ServicePath: "/svc", RemoteHost: upstream.URL, RemotePath: "/v2"}, status: http.StatusOK, body: "remote /v2/users"},
+		{name: "invalid remote host", routed: true, instance: &InstanceType{ID: "svc", RemoteHost: "ftp://backend"}, status: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			injector := &TokenInjector{next: next, lastErrors: NewServiceErrors(), logger: rootLogger}
+			if tt.routed {
+				injector.remoteProxy = newRemoteProxy(time.Second)
+			}
+
+			rec := httptest.NewRecorder()
+			injector.forward(rec, httptest.NewRequest("GET", "/svc/users", nil), tt.instance)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.body)
+			}
+			if tt.status == http.StatusBadGateway {
+				if _, ok := injector.lastErrors.All()[tt.instance.ID]; !ok {
+					t.Error("the routing error was not recorded")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package traefik_token_injector
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TemplateContext holds the request-specific data available to templates
+type TemplateContext struct {
+	Request  *http.Request // Incoming request, used by the header function
+	Token    string        // Authentication token, available as the token variable
+	Response bool          // Response header values, which never see the token or credential headers
+}
+
+// credentialHeaders are the request headers the header function does not read in response header values
+var credentialHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+}
+
+// templateFunc is a template function taking evaluated string arguments
+type templateFunc func(ctx *TemplateContext, args []string) (string, error)
+
+// templateFuncs is the fixed set of functions available to templates
+// Templates cannot call anything outside of this set
+var templateFuncs = map[string]templateFunc{
+	"now":    templateNow,
+	"uuid":   templateUUID,
+	"env":    templateEnv,
+	"header": templateHeader,
+	"base64": templateBase64,
+	"sha256": templateSHA256,
+	"hmac":   templateHMAC,
+}
+
+// EvaluateTemplate evaluates the {{ ... }} expressions in a value
+// Expressions are function calls with string literal, variable or parenthesized call arguments, e.g.
+// {{ now "unix" }}, {{ header "X-Tenant-Id" }} or {{ base64 (hmac (env "SECRET") token) }}
+func EvaluateTemplate(value string, ctx *TemplateContext) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	if ctx == nil {
+		ctx = &TemplateContext{}
+	}
+
+	var result strings.Builder
+	rest := value
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			result.WriteString(rest)
+			break
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated template expression in '%s'", value)
+		}
+
+		result.WriteString(rest[:start])
+		out, err := evaluateTemplateExpression(rest[start+2:start+end], ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to evaluate template '%s': %w", value, err)
+		}
+		result.WriteString(out)
+		rest = rest[start+end+2:]
+	}
+
+	return result.String(), nil
+}
+
+// evaluateTemplateExpression parses and evaluates a single template expression
+func evaluateTemplateExpression(expr string, ctx *TemplateContext) (string, error) {
+	tokens, err := tokenizeTemplate(expr)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("empty expression")
+	}
+
+	p := &templateParser{tokens: tokens, ctx: ctx}
+	value, err := p.parseCall()
+	if err != nil {
+		return "", err
+	}
+	if p.pos != len(p.tokens) {
+		return "", fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	return value, nil
+}
+
+// tokenizeTemplate splits an expression into identifiers, quoted strings and parentheses
+func tokenizeTemplate(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+
+		case c == '"':
+			j := i + 1
+			for j < len(expr) && expr[j] != '"' {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte(" \t\n\r()\"", expr[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// templateParser evaluates a tokenized template expression
+type templateParser struct {
+	tokens []string
+	pos    int
+	ctx    *TemplateContext
+}
+
+// parseCall evaluates a function call or a single value
+func (p *templateParser) parseCall() (string, error) {
+	name := p.tokens[p.pos]
+	fn, ok := templateFuncs[name]
+	if !ok {
+		// Not a function, the expression is a single value
+		return p.parseValue()
+	}
+	p.pos++
+
+	var args []string
+	for p.pos < len(p.tokens) && p.tokens[p.pos] != ")" {
+		arg, err := p.parseValue()
+		if err != nil {
+			return "", err
+		}
+		args = append(args, arg)
+	}
+
+	return fn(p.ctx, args)
+}
+
+// parseValue evaluates a string literal, variable or parenthesized call
+func (p *templateParser) parseValue() (string, error) {
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch {
+	case token == "(":
+		if p.pos >= len(p.tokens) {
+			return "", fmt.Errorf("unterminated '('")
+		}
+		value, err := p.parseCall()
+		if err != nil {
+			return "", err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos] != ")" {
+			return "", fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return value, nil
+
+	case strings.HasPrefix(token, `"`):
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s: %w", token, err)
+		}
+		return value, nil
+
+	case token == "token":
+		if p.ctx.Response {
+			return "", fmt.Errorf("token is not available in response header values")
+		}
+		return p.ctx.Token, nil
+
+	default:
+		if _, ok := templateFuncs[token]; ok {
+			return "", fmt.Errorf("function '%s' must be called in parentheses when used as an argument", token)
+		}
+		return "", fmt.Errorf("unknown identifier '%s'", token)
+	}
+}
+
+// templateNow returns the current time, formatted as RFC 3339, "unix", "unixms" or a Go layout
+func templateNow(ctx *TemplateContext, args []string) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("now expects at most 1 argument")
+	}
+
+	now := time.Now().UTC()
+	format := time.RFC3339
+	if len(args) == 1 {
+		format = args[0]
+	}
+
+	switch format {
+	case "unix":
+		return strconv.FormatInt(now.Unix(), 10), nil
+	case "unixms":
+		return strconv.FormatInt(now.UnixMilli(), 10), nil
+	default:
+		return now.Format(format), nil
+	}
+}
+
+// templateUUID returns a random version 4 UUID
+func templateUUID(ctx *TemplateContext, args []string) (string, error) {
+	if len(args) != 0 {
+		return "", fmt.Errorf("uuid expects no arguments")
+	}
+	return newUUID()
+}
+
+// templateEnvAccess controls which environment variables the env function may read
+var templateEnvAccess struct {
+	mu      sync.RWMutex
+	allowed []string // Names, a trailing * matches a prefix
+	denied  []string // Variables holding secrets of the plugin itself
+}
+
+// ConfigureTemplates applies the template settings of the global configuration
+func ConfigureTemplates(config *GlobalConfig) {
+	denied := []string{config.CacheKeyEnv}
+	if config.Admin != nil && config.Admin.TokenEnv != "" {
+		denied = append(denied, config.Admin.TokenEnv)
+	}
+
+	templateEnvAccess.mu.Lock()
+	defer templateEnvAccess.mu.Unlock()
+	templateEnvAccess.allowed = append([]string{}, config.TemplateEnv...)
+	templateEnvAccess.denied = denied
+}
+
+// templateEnvAllowed reports whether the env function may read a variable
+// Nothing is readable unless template_env allows it, the plugin's own secrets never are
+func templateEnvAllowed(name string) bool {
+	templateEnvAccess.mu.RLock()
+	defer templateEnvAccess.mu.RUnlock()
+
+	for _, denied := range templateEnvAccess.denied {
+		if name == denied {
+			return false
+		}
+	}
+	for _, allowed := range templateEnvAccess.allowed {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// templateEnv returns the value of an environment variable allowed by template_env
+func templateEnv(ctx *TemplateContext, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("env expects 1 argument")
+	}
+	if !templateEnvAllowed(args[0]) {
+		return "", fmt.Errorf("environment variable '%s' is not allowed by template_env", args[0])
+	}
+	return os.Getenv(args[0]), nil
+}
+
+// templateHeader returns the value of a header of the incoming request
+func templateHeader(ctx *TemplateContext, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("header expects 1 argument")
+	}
+	if ctx.Request == nil {
+		return "", fmt.Errorf("header is only available in header values, not in credential data")
+	}
+	if ctx.Response && credentialHeaders[http.CanonicalHeaderKey(args[0])] {
+		return "", fmt.Errorf("header '%s' is not available in response header values", args[0])
+	}
+	return ctx.Request.Header.Get(args[0]), nil
+}
+
+// templateBase64 returns the standard base64 encoding of its argument
+func templateBase64(ctx *TemplateContext, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("base64 expects 1 argument")
+	}
+	return base64.StdEncoding.EncodeToString([]byte(args[0])), nil
+}
+
+// templateSHA256 returns the hex encoded SHA-256 digest of its argument
+func templateSHA256(ctx *TemplateContext, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("sha256 expects 1 argument")
+	}
+	sum := sha256.Sum256([]byte(args[0]))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// templateHMAC returns the hex encoded HMAC-SHA256 of a message: hmac KEY MESSAGE
+func templateHMAC(ctx *TemplateContext, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("hmac expects 2 arguments")
+	}
+	mac := hmac.New(sha256.New, []byte(args[0]))
+	mac.Write([]byte(args[1]))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newUUID generates a random version 4 UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate uuid: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
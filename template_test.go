@@ -0,0 +1,218 @@
+package traefik_token_injector
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateTemplate(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant-Id", "tenant-1")
+	ctx := &TemplateContext{Request: req, Token: "abc"}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "plain value", value: "no templates", want: "no templates"},
+		{name: "token variable", value: "Bearer {{ token }}", want: "Bearer abc"},
+		{name: "string literal", value: `{{ "a \"quoted\" value" }}`, want: `a "quoted" value`},
+		{name: "header", value: `{{ header "X-Tenant-Id" }}`, want: "tenant-1"},
+		{name: "missing header", value: `[{{ header "X-Missing" }}]`, want: "[]"},
+		{name: "base64", value: `{{ base64 token }}`, want: "YWJj"},
+		{name: "sha256", value: `{{ sha256 "abc" }}`, want: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{name: "hmac", value: `{{ hmac "key" "The quick brown fox jumps over the lazy dog" }}`, want: "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{name: "nested calls", value: `{{ base64 (sha256 (header "X-Tenant-Id")) }}`, want: "MGE5NmFiYjMzYjA3ZmYwZThmNDhiY2M0ODkzZTBlNzM0NmJmZjg5OWRkMzE2OTc5NTE3ZmEwNjUwOWE0OWFmZg=="},
+		{name: "several expressions", value: `{{ token }}:{{ header "X-Tenant-Id" }}`, want: "abc:tenant-1"},
+		{name: "no whitespace", value: `{{token}}`, want: "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EvaluateTemplate(tt.value, ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateTemplateGenerated(t *testing.T) {
+	got, err := EvaluateTemplate(`{{ now "unix" }}`, nil)
+	if err != nil {
+		t.Fatalf("now: %v", err)
+	}
+	if _, err := strconv.ParseInt(got, 10, 64); err != nil {
+		t.Errorf("now \"unix\" = %q, want a number", got)
+	}
+
+	got, err = EvaluateTemplate(`{{ now "2006" }}`, nil)
+	if err != nil || len(got) != 4 {
+		t.Errorf("now with a layout = %q, %v", got, err)
+	}
+
+	first, err := EvaluateTemplate(`{{ uuid }}`, nil)
+	if err != nil {
+		t.Fatalf("uuid: %v", err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(first) {
+		t.Errorf("uuid = %q, want a version 4 UUID", first)
+	}
+	if second, _ := EvaluateTemplate(`{{ uuid }}`, nil); second == first {
+		t.Error("uuid returned the same value twice")
+	}
+}
+
+func TestEvaluateTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		err   string
+	}{
+		{name: "unterminated expression", value: "{{ token", err: "unterminated template expression"},
+		{name: "empty expression", value: "{{ }}", err: "empty expression"},
+		{name: "unknown identifier", value: "{{ secret }}", err: "unknown identifier 'secret'"},
+		{name: "unknown function", value: `{{ exec "ls" }}`, err: "unknown identifier 'exec'"},
+		{name: "unparenthesized call argument", value: `{{ base64 sha256 "a" }}`, err: "must be called in parentheses"},
+		{name: "unterminated string", value: `{{ base64 "abc }}`, err: "unterminated string"},
+		{name: "missing closing parenthesis", value: `{{ base64 (sha256 "a" }}`, err: "missing ')'"},
+		{name: "unterminated parenthesis", value: `{{ base64 ( }}`, err: "unterminated '('"},
+		{name: "trailing value", value: `{{ "a" "b" }}`, err: `unexpected '"b"'`},
+		{name: "too many arguments", value: `{{ uuid "x" }}`, err: "uuid expects no arguments"},
+		{name: "too few arguments", value: `{{ hmac "key" }}`, err: "hmac expects 2 arguments"},
+		{name: "now arguments", value: `{{ now "unix" "utc" }}`, err: "now expects at most 1 argument"},
+		{name: "header without request", value: `{{ header "X-Tenant-Id" }}`, err: "only available in header values"},
+		{name: "env not allowed", value: `{{ env "HOME" }}`, err: "not allowed by template_env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := EvaluateTemplate(tt.value, &TemplateContext{})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEvaluateTemplateEnv(t *testing.T) {
+	t.Setenv("APP_SECRET", "s3cret")
+	t.Setenv("SIGNING_KEY_A", "key-a")
+	t.Setenv("SIGNING_KEY_CACHE", "cache-key")
+	t.Setenv("OTHER", "other")
+
+	ConfigureTemplates(&GlobalConfig{
+		TemplateEnv: []string{"APP_SECRET", "SIGNING_KEY_*"},
+		CacheKeyEnv: "SIGNING_KEY_CACHE",
+	})
+	t.Cleanup(func() { ConfigureTemplates(&GlobalConfig{}) })
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		allowed bool
+	}{
+		{name: "exact name", value: `{{ env "APP_SECRET" }}`, want: "s3cret", allowed: true},
+		{name: "prefix", value: `{{ env "SIGNING_KEY_A" }}`, want: "key-a", allowed: true},
+		{name: "plugin secret matching a prefix", value: `{{ env "SIGNING_KEY_CACHE" }}`},
+		{name: "not listed", value: `{{ env "OTHER" }}`},
+		{name: "exact name is not a prefix", value: `{{ env "APP_SECRET_2" }}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EvaluateTemplate(tt.value, nil)
+			if !tt.allowed {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCredentialTemplates(t *testing.T) {
+	credentialData := []CredentialsPairType{
+		{Key: "user", Value: `{{ base64 "admin" }}`, Template: true},
+		{Key: "code", Value: "{{ token }}", Template: true, Totp: &TotpType{Secret: "GEZDGNBVGY3TQOJQ"}},
+		{Key: "password", Value: "p{{ss}}"},
+	}
+
+	resolved, err := ResolveCredentialTemplates(credentialData)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resolved[0].Value != "YWRtaW4=" {
+		t.Errorf("user = %q, want YWRtaW4=", resolved[0].Value)
+	}
+	// TOTP pairs are generated later and never evaluated as templates
+	if resolved[1].Value != "{{ token }}" {
+		t.Errorf("code = %q, want it unchanged", resolved[1].Value)
+	}
+	// Values not marked as templates are used literally
+	if resolved[2].Value != "p{{ss}}" {
+		t.Errorf("password = %q, want it unchanged", resolved[2].Value)
+	}
+	if credentialData[0].Value != `{{ base64 "admin" }}` {
+		t.Error("the credential data was modified")
+	}
+
+	if _, err := ResolveCredentialTemplates([]CredentialsPairType{{Key: "tenant", Value: `{{ header "X-Tenant-Id" }}`, Template: true}}); err == nil {
+		t.Error("header was evaluated in credential data")
+	}
+}
+
+func TestEvaluateTemplateResponse(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant-Id", "tenant-1")
+	req.Header.Set("Authorization", "Bearer client")
+	ctx := &TemplateContext{Request: req, Token: "abc", Response: true}
+
+	if got, err := EvaluateTemplate(`{{ header "X-Tenant-Id" }}`, ctx); err != nil || got != "tenant-1" {
+		t.Errorf("header = %q, %v, want tenant-1", got, err)
+	}
+	for _, value := range []string{`{{ token }}`, `{{ base64 token }}`, `{{ header "Authorization" }}`, `{{ header "proxy-authorization" }}`} {
+		if got, err := EvaluateTemplate(value, ctx); err == nil {
+			t.Errorf("%s = %q in a response header, want an error", value, got)
+		}
+	}
+}
+
+func TestResolveHeadersLiteralValues(t *testing.T) {
+	headers := []HeaderType{
+		{Key: "X-Literal", Value: "a {{ b }} {{"},
+		{Key: "X-Template", Value: "{{ token }}", Template: true},
+		{Key: "X-Escaped", Value: `{{ "{{" }} token }}`, Template: true},
+		{Key: "X-Removed", Operation: HeaderOperationRemove, Template: true},
+	}
+
+	resolved, err := ResolveHeaders(headers, &TemplateContext{Token: "abc"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"a {{ b }} {{", "abc", "{{ token }}", ""}
+	for i, header := range resolved {
+		if header.Value != want[i] {
+			t.Errorf("%s = %q, want %q", header.Key, header.Value, want[i])
+		}
+	}
+}
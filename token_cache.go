@@ -1,33 +1,104 @@
 package traefik_token_injector
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // TokenCache manages cached authentication tokens with TTL support
+// The cache is bounded: when full, the least recently used token is evicted
 type TokenCache struct {
-	mu     sync.RWMutex
-	tokens map[string]*CachedToken
+	mu         sync.Mutex
+	tokens     map[string]*list.Element
+	order      *list.List
+	maxEntries int
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	refreshes uint64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+
+	// Optional encrypted file the entries are written through to
+	file      *TokenFile
+	persistMu sync.Mutex
+
+	// Optional store shared with other replicas
+	remote  TokenStore
+	lockTtl time.Duration
 }
 
-// NewTokenCache creates a new token cache
-func NewTokenCache() *TokenCache {
+// tokenCacheEntry is an element of the LRU list
+type tokenCacheEntry struct {
+	key    string
+	cached *CachedToken
+}
+
+// CacheStats holds the counters of a token cache
+type CacheStats struct {
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Refreshes uint64
+}
+
+// NewTokenCache creates a new token cache holding at most maxEntries tokens (0 means unbounded)
+func NewTokenCache(maxEntries int) *TokenCache {
 	return &TokenCache{
-		tokens: make(map[string]*CachedToken),
+		tokens:     make(map[string]*list.Element),
+		order:      list.New(),
+		maxEntries: maxEntries,
+		stop:       make(chan struct{}),
 	}
 }
 
-// Get retrieves a token from the cache
+// Get retrieves a token from the cache by its cache key
 // Returns the token and a boolean indicating if refresh is needed
-func (c *TokenCache) Get(serviceId string, refreshBuffer int) (token string, needsRefresh bool, exists bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// A token obtained for a different instance state than tag is invalidated
+// With a shared store, tokens missing locally or due for refresh are looked up in the store
+func (c *TokenCache) Get(key string, refreshBuffer int, tag TokenTag) (token string, needsRefresh bool, exists bool) {
+	token, needsRefresh, exists = c.getLocal(key, tag)
 
-	cached, ok := c.tokens[serviceId]
+	// Another replica may already hold a valid or fresher token
+	if c.remote != nil && (!exists || needsRefresh) && c.adoptRemote(key, tag) {
+		token, needsRefresh, exists = c.getLocal(key, tag)
+	}
+
+	switch {
+	case !exists:
+		atomic.AddUint64(&c.misses, 1)
+	case needsRefresh:
+		atomic.AddUint64(&c.refreshes, 1)
+	default:
+		atomic.AddUint64(&c.hits, 1)
+	}
+	return token, needsRefresh, exists
+}
+
+// getLocal looks a token up in the local entries
+func (c *TokenCache) getLocal(key string, tag TokenTag) (token string, needsRefresh bool, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.tokens[key]
 	if !ok {
 		return "", false, false
 	}
+	cached := elem.Value.(*tokenCacheEntry).cached
+
+	// Invalidate tokens obtained before the instance or its credentials changed
+	if cached.Tag != tag {
+		c.removeElement(elem)
+		return "", false, false
+	}
 
 	now := time.Now().Unix()
 
@@ -36,6 +107,8 @@ func (c *TokenCache) Get(serviceId string, refreshBuffer int) (token string, nee
 		return "", false, false
 	}
 
+	c.order.MoveToFront(elem)
+
 	// Check if token needs refresh (within refresh buffer)
 	if cached.RefreshAt != nil && *cached.RefreshAt <= now {
 		return cached.Token, true, true
@@ -44,13 +117,15 @@ func (c *TokenCache) Get(serviceId string, refreshBuffer int) (token string, nee
 	return cached.Token, false, true
 }
 
-// Set stores a token in the cache with optional TTL
-func (c *TokenCache) Set(serviceId string, token string, ttl *int, refreshBuffer int) {
+// Set stores a token of a service in the cache with optional TTL, tagged with the instance state it was obtained for
+func (c *TokenCache) Set(key string, serviceId string, token string, ttl *int, refreshBuffer int, tag TokenTag, source string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 
 	cached := &CachedToken{
-		Token: token,
+		ServiceId: serviceId,
+		Token:     token,
+		Tag:       tag,
+		Source:    source,
 	}
 
 	// If TTL is provided (not null), calculate expiration and refresh times
@@ -71,21 +146,359 @@ func (c *TokenCache) Set(serviceId string, token string, ttl *int, refreshBuffer
 	}
 	// If TTL is null, ExpiresAt and RefreshAt remain nil (no expiration)
 
-	c.tokens[serviceId] = cached
+	c.store(key, cached)
+	c.mu.Unlock()
+
+	c.persist()
+
+	if c.remote != nil {
+		if err := c.remote.Set(key, cached); err != nil {
+			rootLogger.Warn("Failed to share cached token", "error", err)
+		}
+	}
 }
 
-// Delete removes a token from the cache
-func (c *TokenCache) Delete(serviceId string) {
+// store inserts or replaces an entry and evicts the least recently used entries if the cache is full
+// The caller must hold the lock
+func (c *TokenCache) store(key string, cached *CachedToken) {
+	if elem, ok := c.tokens[key]; ok {
+		elem.Value.(*tokenCacheEntry).cached = cached
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.tokens[key] = c.order.PushFront(&tokenCacheEntry{key: key, cached: cached})
+
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// removeElement removes an element from the cache, the caller must hold the lock
+func (c *TokenCache) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.tokens, elem.Value.(*tokenCacheEntry).key)
+}
+
+// Delete removes a token from the cache by its cache key
+func (c *TokenCache) Delete(key string) {
+	c.mu.Lock()
+	elem, ok := c.tokens[key]
+	if ok {
+		c.removeElement(elem)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		c.persist()
+	}
+	c.deleteRemote(key)
+}
+
+// DeleteService removes all tokens of a service from the cache and returns how many were removed
+func (c *TokenCache) DeleteService(serviceId string) int {
+	c.mu.Lock()
+	var keys []string
+	for key, elem := range c.tokens {
+		if elem.Value.(*tokenCacheEntry).cached.ServiceId == serviceId {
+			c.removeElement(elem)
+			keys = append(keys, key)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(keys) > 0 {
+		c.persist()
+	}
+	for _, key := range keys {
+		c.deleteRemote(key)
+	}
+	return len(keys)
+}
+
+// Inspect returns a copy of the cache entry stored under a cache key
+func (c *TokenCache) Inspect(key string) (CachedToken, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	delete(c.tokens, serviceId)
+	elem, ok := c.tokens[key]
+	if !ok {
+		return CachedToken{}, false
+	}
+	return *elem.Value.(*tokenCacheEntry).cached, true
+}
+
+// Entries returns copies of the cache entries of a service keyed by cache key, or of all services if serviceId is empty
+func (c *TokenCache) Entries(serviceId string) map[string]CachedToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make(map[string]CachedToken)
+	for key, elem := range c.tokens {
+		cached := elem.Value.(*tokenCacheEntry).cached
+		if serviceId == "" || cached.ServiceId == serviceId {
+			entries[key] = *cached
+		}
+	}
+	return entries
 }
 
 // Clear removes all tokens from the cache
 func (c *TokenCache) Clear() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.tokens = make(map[string]*list.Element)
+	c.order.Init()
+	c.mu.Unlock()
+
+	c.persist()
+}
+
+// Stats returns the current counters of the cache
+func (c *TokenCache) Stats() CacheStats {
+	c.mu.Lock()
+	entries := len(c.tokens)
+	c.mu.Unlock()
+
+	return CacheStats{
+		Entries:   entries,
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+		Refreshes: atomic.LoadUint64(&c.refreshes),
+	}
+}
+
+// RemoveExpired removes all expired tokens and returns how many were removed
+func (c *TokenCache) RemoveExpired() int {
+	c.mu.Lock()
+	now := time.Now().Unix()
+	removed := 0
+	for _, elem := range c.tokens {
+		cached := elem.Value.(*tokenCacheEntry).cached
+		if cached.ExpiresAt != nil && *cached.ExpiresAt <= now {
+			c.removeElement(elem)
+			removed++
+		}
+	}
+
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.evictions, uint64(removed))
+	if removed > 0 {
+		c.persist()
+	}
+	return removed
+}
+
+// PersistTo restores the unexpired entries of an encrypted token file and writes all later changes through to it
+// Returns the number of restored tokens
+func (c *TokenCache) PersistTo(file *TokenFile) (int, error) {
+	entries, err := file.Load()
+
+	c.persistMu.Lock()
+	c.file = file
+	c.persistMu.Unlock()
+
+	if err != nil {
+		// The file is replaced on the next write, e.g. after the key was rotated
+		return 0, err
+	}
+
+	c.mu.Lock()
+	for key, cached := range entries {
+		cached := cached
+		cached.Source = TokenSourceFile
+		c.store(key, &cached)
+	}
+	c.mu.Unlock()
+
+	return len(entries), nil
+}
+
+// UseStore shares the tokens of the cache with other replicas through a token store
+// Only one replica at a time refreshes a token, holding the refresh lock for at most lockTtl
+func (c *TokenCache) UseStore(store TokenStore, lockTtl time.Duration) {
+	c.remote = store
+	c.lockTtl = lockTtl
+}
 
-	c.tokens = make(map[string]*CachedToken)
+// AcquireRefresh acquires the lock for refreshing the token stored under a cache key
+// Without a shared store the lock is always acquired; if the store fails, the token is refreshed without lock
+func (c *TokenCache) AcquireRefresh(key string) (release func(), acquired bool) {
+	if c.remote == nil {
+		return func() {}, true
+	}
+
+	release, acquired, err := c.remote.TryLock(key, c.lockTtl)
+	if err != nil {
+		rootLogger.Warn("Failed to acquire token refresh lock", "error", err)
+		return func() {}, true
+	}
+	if !acquired {
+		return nil, false
+	}
+	return release, true
+}
+
+// WaitForRefresh waits until another replica stored a fresh token under a cache key
+// Gives up once the refresh lock of that replica would have expired
+func (c *TokenCache) WaitForRefresh(key string, tag TokenTag) (string, bool) {
+	if c.remote == nil {
+		return "", false
+	}
+
+	deadline := time.Now().Add(c.lockTtl)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		c.adoptRemote(key, tag)
+		if token, needsRefresh, exists := c.getLocal(key, tag); exists && !needsRefresh {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// adoptRemote copies a token of the shared store into the local entries if it is valid for tag
+// and fresher than the local one; returns whether a token was adopted
+func (c *TokenCache) adoptRemote(key string, tag TokenTag) bool {
+	cached, err := c.remote.Get(key)
+	if err != nil {
+		rootLogger.Warn("Failed to read shared token", "error", err)
+		return false
+	}
+	if cached == nil || cached.Tag != tag {
+		return false
+	}
+	if cached.ExpiresAt != nil && *cached.ExpiresAt <= time.Now().Unix() {
+		return false
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.tokens[key]; ok {
+		local := elem.Value.(*tokenCacheEntry).cached
+		if local.Token == cached.Token || (local.RefreshAt != nil && cached.RefreshAt != nil && *cached.RefreshAt <= *local.RefreshAt) {
+			c.mu.Unlock()
+			return false
+		}
+	}
+	cached.Source = TokenSourceStore
+	c.store(key, cached)
+	c.mu.Unlock()
+
+	c.persist()
+	return true
+}
+
+// deleteRemote removes a token from the shared store, if any
+func (c *TokenCache) deleteRemote(key string) {
+	if c.remote == nil {
+		return
+	}
+	if err := c.remote.Delete(key); err != nil {
+		rootLogger.Warn("Failed to delete shared token", "error", err)
+	}
+}
+
+// persist writes the current entries to the token file, if any
+// Writes are serialized so the file always reflects the latest snapshot
+func (c *TokenCache) persist() {
+	c.persistMu.Lock()
+	defer c.persistMu.Unlock()
+
+	if c.file == nil {
+		return
+	}
+	if err := c.file.Save(c.Entries("")); err != nil {
+		rootLogger.Warn("Failed to persist token cache", "error", err)
+	}
+}
+
+// StartJanitor starts a goroutine removing expired tokens at the given interval until Stop is called
+func (c *TokenCache) StartJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.RemoveExpired()
+			}
+		}
+	}()
+}
+
+// Stop stops the janitor goroutine
+func (c *TokenCache) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// NewTokenTag returns the tag identifying the current state of an instance
+func NewTokenTag(instance *InstanceType) TokenTag {
+	return TokenTag{
+		VersionID:   instance.VersionID,
+		UpdatedAt:   instance.UpdatedAt,
+		Fingerprint: CredentialsFingerprint(instance.Credentials),
+	}
+}
+
+// CacheKey returns the cache key of the token of a service obtained with the given credentials
+// The key combines the service ID with a hash of the auth-relevant credential fields, so middlewares
+// using different credentials for the same instance do not collide and rotated credentials miss the cache
+func CacheKey(serviceId string, credentials *CredentialsType) string {
+	return serviceId + "#" + authFingerprint(credentials)
+}
+
+// authFingerprint returns a stable hash of the credential fields used to obtain a token
+func authFingerprint(credentials *CredentialsType) string {
+	if credentials == nil {
+		return ""
+	}
+
+	data, err := json.Marshal(struct {
+		AuthType       string
+		EndpointType   string
+		TokenLocation  string
+		CredentialData []CredentialsPairType
+		EndpointData   *EndpointConnection
+		LoginSteps     []LoginStepType
+		ApiKey         string
+	}{
+		AuthType:       credentials.AuthType,
+		EndpointType:   credentials.EndpointType,
+		TokenLocation:  credentials.TokenLocation,
+		CredentialData: credentials.CredentialData,
+		EndpointData:   credentials.EndpointData,
+		LoginSteps:     credentials.LoginSteps,
+		ApiKey:         credentials.ApiKey,
+	})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// CredentialsFingerprint returns a stable hash of the credentials configuration
+// The pre-existing token and its expiry are excluded, so writing a token back does not invalidate cached tokens
+func CredentialsFingerprint(credentials *CredentialsType) string {
+	if credentials == nil {
+		return ""
+	}
+
+	// Struct fields are marshaled in declaration order, so the encoding is stable
+	configuration := *credentials
+	configuration.Token = nil
+	configuration.TokenExpiresAt = nil
+	data, err := json.Marshal(&configuration)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,173 @@
+package traefik_token_injector
+
+import (
+	"testing"
+	"time"
+)
+
+// storeExpiring stores a token expiring at the given unix time, bypassing the TTL computation of Set
+func storeExpiring(c *TokenCache, key string, serviceId string, expiresAt int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(key, &CachedToken{ServiceId: serviceId, Token: key, ExpiresAt: &expiresAt})
+}
+
+func TestTokenCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewTokenCache(2)
+	tag := TokenTag{}
+
+	cache.Set("a", "svc", "token-a", nil, 0, tag, TokenSourceLogin)
+	cache.Set("b", "svc", "token-b", nil, 0, tag, TokenSourceLogin)
+
+	// Reading a makes b the least recently used entry
+	if _, _, exists := cache.Get("a", 0, tag); !exists {
+		t.Fatal("a is missing")
+	}
+	cache.Set("c", "svc", "token-c", nil, 0, tag, TokenSourceLogin)
+
+	if _, _, exists := cache.Get("b", 0, tag); exists {
+		t.Error("b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, exists := cache.Get(key, 0, tag); !exists {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("stats = %+v, want 2 entries and 1 eviction", stats)
+	}
+}
+
+func TestTokenCacheReplaceDoesNotEvict(t *testing.T) {
+	cache := NewTokenCache(2)
+	tag := TokenTag{}
+
+	cache.Set("a", "svc", "token-a", nil, 0, tag, TokenSourceLogin)
+	cache.Set("b", "svc", "token-b", nil, 0, tag, TokenSourceLogin)
+	cache.Set("a", "svc", "token-a2", nil, 0, tag, TokenSourceLogin)
+
+	if token, _, _ := cache.Get("a", 0, tag); token != "token-a2" {
+		t.Errorf("a = %q, want token-a2", token)
+	}
+	if _, _, exists := cache.Get("b", 0, tag); !exists {
+		t.Error("b was evicted by replacing a")
+	}
+}
+
+func TestTokenCacheUnbounded(t *testing.T) {
+	cache := NewTokenCache(0)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		cache.Set(key, "svc", key, nil, 0, TokenTag{}, TokenSourceLogin)
+	}
+	if stats := cache.Stats(); stats.Entries != 4 || stats.Evictions != 0 {
+		t.Errorf("stats = %+v, want 4 entries and no eviction", stats)
+	}
+}
+
+func TestTokenCacheTTL(t *testing.T) {
+	tag := TokenTag{}
+	ttl := func(seconds int) *int { return &seconds }
+
+	tests := []struct {
+		name         string
+		ttl          *int
+		buffer       int
+		needsRefresh bool
+		expires      bool
+	}{
+		{name: "no ttl", ttl: nil, buffer: 10},
+		{name: "zero ttl", ttl: ttl(0), buffer: 10},
+		{name: "outside the refresh buffer", ttl: ttl(60), buffer: 10, expires: true},
+		{name: "inside the refresh buffer", ttl: ttl(5), buffer: 10, needsRefresh: true, expires: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewTokenCache(10)
+			before := time.Now().Unix()
+			cache.Set("svc", "svc", "token", tt.ttl, tt.buffer, tag, TokenSourceLogin)
+			after := time.Now().Unix()
+
+			token, needsRefresh, exists := cache.Get("svc", tt.buffer, tag)
+			if !exists || token != "token" {
+				t.Fatalf("Get = %q, %v, want the token", token, exists)
+			}
+			if needsRefresh != tt.needsRefresh {
+				t.Errorf("needsRefresh = %v, want %v", needsRefresh, tt.needsRefresh)
+			}
+
+			cached, _ := cache.Inspect("svc")
+			if (cached.ExpiresAt != nil) != tt.expires {
+				t.Errorf("ExpiresAt = %v, want set: %v", cached.ExpiresAt, tt.expires)
+			}
+			if tt.expires && (*cached.ExpiresAt < before+int64(*tt.ttl) || *cached.ExpiresAt > after+int64(*tt.ttl)) {
+				t.Errorf("ExpiresAt = %d, want now + %d", *cached.ExpiresAt, *tt.ttl)
+			}
+		})
+	}
+}
+
+func TestTokenCacheExpiredToken(t *testing.T) {
+	cache := NewTokenCache(10)
+	now := time.Now().Unix()
+	storeExpiring(cache, "expired", "svc", now-1)
+	storeExpiring(cache, "valid", "svc", now+60)
+	storeExpiring(cache, "other", "other", now-1)
+
+	if _, _, exists := cache.Get("expired", 0, TokenTag{}); exists {
+		t.Error("an expired token was returned")
+	}
+
+	if removed := cache.RemoveExpired(); removed != 2 {
+		t.Errorf("RemoveExpired = %d, want 2", removed)
+	}
+	if _, ok := cache.Inspect("valid"); !ok {
+		t.Error("RemoveExpired removed a valid token")
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Evictions != 2 {
+		t.Errorf("stats = %+v, want 1 entry and 2 evictions", stats)
+	}
+}
+
+func TestTokenCacheInvalidatesOtherTag(t *testing.T) {
+	cache := NewTokenCache(10)
+	cache.Set("svc", "svc", "token", nil, 0, TokenTag{VersionID: "1"}, TokenSourceLogin)
+
+	if _, _, exists := cache.Get("svc", 0, TokenTag{VersionID: "2"}); exists {
+		t.Error("a token of another instance version was returned")
+	}
+	if _, ok := cache.Inspect("svc"); ok {
+		t.Error("the token of another instance version was not removed")
+	}
+}
+
+func TestTokenCacheDeleteService(t *testing.T) {
+	cache := NewTokenCache(10)
+	cache.Set("a#1", "a", "token", nil, 0, TokenTag{}, TokenSourceLogin)
+	cache.Set("a#2", "a", "token", nil, 0, TokenTag{}, TokenSourceLogin)
+	cache.Set("b#1", "b", "token", nil, 0, TokenTag{}, TokenSourceLogin)
+
+	if removed := cache.DeleteService("a"); removed != 2 {
+		t.Errorf("DeleteService = %d, want 2", removed)
+	}
+	if entries := cache.Entries(""); len(entries) != 1 {
+		t.Errorf("entries = %v, want only b#1", entries)
+	}
+}
+
+func TestTokenCacheStats(t *testing.T) {
+	cache := NewTokenCache(10)
+	ttl := 5
+	cache.Get("svc", 10, TokenTag{})
+	cache.Set("svc", "svc", "token", &ttl, 10, TokenTag{}, TokenSourceLogin)
+	cache.Get("svc", 10, TokenTag{})
+	cache.Set("other", "other", "token", nil, 0, TokenTag{}, TokenSourceLogin)
+	cache.Get("other", 0, TokenTag{})
+
+	stats := cache.Stats()
+	if stats.Misses != 1 || stats.Refreshes != 1 || stats.Hits != 1 {
+		t.Errorf("stats = %+v, want 1 miss, 1 refresh and 1 hit", stats)
+	}
+}
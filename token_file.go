@@ -0,0 +1,175 @@
+package traefik_token_injector
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenFileMagic prefixes every token file and is authenticated with the encrypted payload
+var tokenFileMagic = []byte("TTIC1")
+
+// TokenFile persists cache entries in an AES-GCM encrypted file
+// Tokens are never written to disk in plaintext
+type TokenFile struct {
+	mu   sync.Mutex
+	path string
+	aead cipher.AEAD
+}
+
+// tokenFilePayload is the plaintext content of a token file
+type tokenFilePayload struct {
+	Entries map[string]CachedToken
+}
+
+// NewTokenFile creates a token file at path encrypted with a 32 byte AES-256 key
+func NewTokenFile(path string, key []byte) (*TokenFile, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("cache key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return &TokenFile{path: path, aead: aead}, nil
+}
+
+// LoadCacheKey reads the base64 encoded cache key from the configured key file or environment variable
+func LoadCacheKey(config *GlobalConfig) ([]byte, error) {
+	var encoded string
+	if config.CacheKeyFile != "" {
+		data, err := os.ReadFile(config.CacheKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache key file: %w", err)
+		}
+		encoded = string(data)
+	} else {
+		encoded = os.Getenv(config.CacheKeyEnv)
+		if encoded == "" {
+			return nil, fmt.Errorf("cache key environment variable %s is not set", config.CacheKeyEnv)
+		}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("cache key is not valid base64: %w", err)
+	}
+	return key, nil
+}
+
+// TokenFilePath returns the token file of a middleware in the cache directory
+func TokenFilePath(dir string, name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+	return filepath.Join(dir, safe+".tokens")
+}
+
+// Load decrypts the token file and returns the entries that have not expired
+// A missing file is not an error and yields no entries
+func (f *TokenFile) Load() (map[string]CachedToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]CachedToken{}, nil
+		}
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	nonceSize := f.aead.NonceSize()
+	if len(data) < len(tokenFileMagic)+nonceSize || !bytes.Equal(data[:len(tokenFileMagic)], tokenFileMagic) {
+		return nil, fmt.Errorf("token file %s has an unknown format", f.path)
+	}
+	data = data[len(tokenFileMagic):]
+
+	plaintext, err := f.aead.Open(nil, data[:nonceSize], data[nonceSize:], tokenFileMagic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token file %s: %w", f.path, err)
+	}
+
+	var payload tokenFilePayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse token file %s: %w", f.path, err)
+	}
+
+	// Expired tokens are dropped instead of being restored
+	now := time.Now().Unix()
+	entries := make(map[string]CachedToken, len(payload.Entries))
+	for key, cached := range payload.Entries {
+		if cached.ExpiresAt != nil && *cached.ExpiresAt <= now {
+			continue
+		}
+		entries[key] = cached
+	}
+	return entries, nil
+}
+
+// Save encrypts the entries and atomically replaces the token file
+func (f *TokenFile) Save(entries map[string]CachedToken) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	plaintext, err := json.Marshal(tokenFilePayload{Entries: entries})
+	if err != nil {
+		return fmt.Errorf("failed to encode tokens: %w", err)
+	}
+
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	data := append([]byte{}, tokenFileMagic...)
+	data = append(data, nonce...)
+	data = f.aead.Seal(data, nonce, plaintext, tokenFileMagic)
+
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	// Write to a temporary file in the same directory and rename it, so readers never see a partial file
+	tmp, err := os.CreateTemp(dir, filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary token file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync token file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close token file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace token file: %w", err)
+	}
+	return nil
+}
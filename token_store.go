@@ -0,0 +1,347 @@
+package traefik_token_injector
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenStore is a backend shared by the token caches of several Traefik replicas
+type TokenStore interface {
+	// Get returns the token stored under a cache key, or nil if there is none
+	Get(key string) (*CachedToken, error)
+	// Set stores a token under a cache key until it expires
+	Set(key string, cached *CachedToken) error
+	// Delete removes the token stored under a cache key
+	Delete(key string) error
+	// TryLock acquires the refresh lock of a cache key for at most ttl
+	// Returns a function releasing the lock and whether the lock was acquired
+	TryLock(key string, ttl time.Duration) (func(), bool, error)
+	// Close releases the resources of the store
+	Close() error
+}
+
+// errRedisNil is returned for nil replies
+var errRedisNil = errors.New("redis: nil reply")
+
+// tokenStoreMagic prefixes every stored token and is authenticated with the encrypted payload
+var tokenStoreMagic = []byte("TTIS1")
+
+// releaseLockScript deletes a refresh lock only if it still holds the owner value
+// The check and the delete run atomically on the server
+const releaseLockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// RedisTokenStore stores tokens in a server speaking the Redis protocol (RESP)
+// Tokens are encrypted with the cache key, the server never sees them in plaintext
+type RedisTokenStore struct {
+	address  string
+	username string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+	aead     cipher.AEAD
+	pool     chan *redisConn
+}
+
+// redisConn is a connection to the Redis server
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisTokenStore creates a token store for the Redis server configured in the global configuration
+// Tokens are encrypted with a 32 byte AES-256 key shared by all replicas
+func NewRedisTokenStore(config *GlobalConfig, key []byte) (*RedisTokenStore, error) {
+	timeout, err := config.GetTimeout()
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("cache key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return &RedisTokenStore{
+		address:  config.RedisAddress,
+		username: config.RedisUsername,
+		password: config.RedisPassword,
+		db:       config.RedisDB,
+		prefix:   config.RedisKeyPrefix,
+		timeout:  timeout,
+		aead:     aead,
+		pool:     make(chan *redisConn, 8),
+	}, nil
+}
+
+// Get returns the token stored under a cache key, or nil if there is none
+func (s *RedisTokenStore) Get(key string) (*CachedToken, error) {
+	reply, err := s.do("GET", s.prefix+key)
+	if errors.Is(err, errRedisNil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to GET: %v", reply)
+	}
+	plaintext, err := s.open(key, []byte(data))
+	if err != nil {
+		return nil, err
+	}
+	var cached CachedToken
+	if err := json.Unmarshal(plaintext, &cached); err != nil {
+		return nil, fmt.Errorf("failed to decode stored token: %w", err)
+	}
+	return &cached, nil
+}
+
+// Set stores a token under a cache key, expiring it together with the token
+func (s *RedisTokenStore) Set(key string, cached *CachedToken) error {
+	plaintext, err := json.Marshal(cached)
+	if err != nil {
+		return fmt.Errorf("failed to encode token: %w", err)
+	}
+	data, err := s.seal(key, plaintext)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"SET", s.prefix + key, string(data)}
+	if cached.ExpiresAt != nil {
+		ttl := time.Until(time.Unix(*cached.ExpiresAt, 0))
+		if ttl <= 0 {
+			return nil
+		}
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+
+	_, err = s.do(args...)
+	return err
+}
+
+// Delete removes the token stored under a cache key
+func (s *RedisTokenStore) Delete(key string) error {
+	_, err := s.do("DEL", s.prefix+key)
+	return err
+}
+
+// TryLock acquires the refresh lock of a cache key with SET NX, expiring it after ttl
+// The returned function only releases the lock while it is still held by this store
+func (s *RedisTokenStore) TryLock(key string, ttl time.Duration) (func(), bool, error) {
+	owner := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, owner); err != nil {
+		return nil, false, fmt.Errorf("failed to generate lock owner: %w", err)
+	}
+	value := hex.EncodeToString(owner)
+	lockKey := s.prefix + "lock:" + key
+
+	_, err := s.do("SET", lockKey, value, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if errors.Is(err, errRedisNil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	release := func() {
+		// The lock may have expired and been acquired by another replica in the meantime
+		s.do("EVAL", releaseLockScript, "1", lockKey, value)
+	}
+	return release, true, nil
+}
+
+// seal encrypts a stored value, binding it to its cache key so values cannot be moved between keys
+func (s *RedisTokenStore) seal(key string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	data := append([]byte{}, tokenStoreMagic...)
+	data = append(data, nonce...)
+	return s.aead.Seal(data, nonce, plaintext, append(append([]byte{}, tokenStoreMagic...), key...)), nil
+}
+
+// open decrypts a stored value
+func (s *RedisTokenStore) open(key string, data []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(data) < len(tokenStoreMagic)+nonceSize || string(data[:len(tokenStoreMagic)]) != string(tokenStoreMagic) {
+		return nil, fmt.Errorf("stored token has an unknown format")
+	}
+	data = data[len(tokenStoreMagic):]
+
+	plaintext, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], append(append([]byte{}, tokenStoreMagic...), key...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt stored token: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Close closes the pooled connections
+func (s *RedisTokenStore) Close() error {
+	for {
+		select {
+		case c := <-s.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends a command and returns its reply
+// Replies are strings, int64 values, or slices of replies; nil replies yield errRedisNil
+func (s *RedisTokenStore) do(args ...string) (interface{}, error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(s.timeout, args...)
+	var redisErr redisError
+	if err != nil && !errors.Is(err, errRedisNil) && !errors.As(err, &redisErr) {
+		// The connection is in an unknown state after I/O errors
+		c.conn.Close()
+		return nil, fmt.Errorf("redis %s failed: %w", args[0], err)
+	}
+
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns a pooled connection or dials a new one
+func (s *RedisTokenStore) conn() (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", s.address, err)
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := c.do(s.timeout, args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis authentication failed: %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := c.do(s.timeout, "SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to select redis database %d: %w", s.db, err)
+		}
+	}
+	return c, nil
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do writes a command as an array of bulk strings and reads the reply
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readRESP(c.reader)
+}
+
+// readRESP reads a single reply of the Redis protocol
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk length %q", payload)
+		}
+		if size < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed array length %q", payload)
+		}
+		if count < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			item, err := readRESP(r)
+			if err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown reply type %q", kind)
+	}
+}
@@ -0,0 +1,311 @@
+package traefik_token_injector
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaking the subset of RESP used by RedisTokenStore
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	values   map[string]string
+	commands [][]string
+}
+
+// newFakeRedis starts a fake server, stopped when the test ends
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeRedis{listener: listener, values: make(map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// serve answers the commands of a connection
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		items, ok := request.([]interface{})
+		if !ok {
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if _, err := conn.Write([]byte(f.execute(args))); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a command and returns the encoded reply
+func (f *fakeRedis) execute(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, args)
+
+	switch strings.ToUpper(args[0]) {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		value, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		for _, option := range args[3:] {
+			if strings.EqualFold(option, "NX") {
+				if _, exists := f.values[args[1]]; exists {
+					return "$-1\r\n"
+				}
+			}
+		}
+		f.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		if _, ok := f.values[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		delete(f.values, args[1])
+		return ":1\r\n"
+	case "EVAL":
+		// Only the lock release script is supported: EVAL script 1 key owner
+		if args[1] != releaseLockScript || args[2] != "1" {
+			return "-ERR unknown script\r\n"
+		}
+		if f.values[args[3]] != args[4] {
+			return ":0\r\n"
+		}
+		delete(f.values, args[3])
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// value returns the raw value stored under a key
+func (f *fakeRedis) value(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.values[key]
+	return value, ok
+}
+
+// newTestTokenStore creates a store connected to the fake server
+func newTestTokenStore(t *testing.T, server *fakeRedis, config *GlobalConfig) *RedisTokenStore {
+	t.Helper()
+	config.RedisAddress = server.listener.Addr().String()
+	config.RedisKeyPrefix = "test:"
+	config.Timeout = "2s"
+
+	store, err := NewRedisTokenStore(config, make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewRedisTokenStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRedisTokenStoreSetGet(t *testing.T) {
+	server := newFakeRedis(t)
+	store := newTestTokenStore(t, server, &GlobalConfig{})
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	cached := &CachedToken{ServiceId: "svc", Token: "secret-token", ExpiresAt: &expiresAt, Source: TokenSourceLogin}
+	if err := store.Set("svc#abc", cached); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	raw, ok := server.value("test:svc#abc")
+	if !ok {
+		t.Fatal("token was not stored under the prefixed key")
+	}
+	if strings.Contains(raw, "secret-token") {
+		t.Error("token is stored in plaintext")
+	}
+
+	got, err := store.Get("svc#abc")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !reflect.DeepEqual(got, cached) {
+		t.Errorf("Get = %+v, want %+v", got, cached)
+	}
+
+	missing, err := store.Get("other")
+	if err != nil || missing != nil {
+		t.Errorf("Get of a missing key = %v, %v, want nil, nil", missing, err)
+	}
+}
+
+func TestRedisTokenStoreRejectsMovedValue(t *testing.T) {
+	server := newFakeRedis(t)
+	store := newTestTokenStore(t, server, &GlobalConfig{})
+
+	if err := store.Set("a", &CachedToken{ServiceId: "a", Token: "token-a"}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	raw, _ := server.value("test:a")
+	server.execute([]string{"SET", "test:b", raw})
+
+	if _, err := store.Get("b"); err == nil {
+		t.Error("Get accepted a value copied from another key")
+	}
+}
+
+func TestRedisTokenStoreSkipsExpiredToken(t *testing.T) {
+	server := newFakeRedis(t)
+	store := newTestTokenStore(t, server, &GlobalConfig{})
+
+	expiresAt := time.Now().Add(-time.Minute).Unix()
+	if err := store.Set("svc", &CachedToken{Token: "old", ExpiresAt: &expiresAt}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, ok := server.value("test:svc"); ok {
+		t.Error("expired token was stored")
+	}
+}
+
+func TestRedisTokenStoreTryLock(t *testing.T) {
+	server := newFakeRedis(t)
+	store := newTestTokenStore(t, server, &GlobalConfig{})
+
+	release, acquired, err := store.TryLock("svc", time.Minute)
+	if err != nil || !acquired {
+		t.Fatalf("TryLock = %v, %v, want acquired", acquired, err)
+	}
+	if _, acquired, _ := store.TryLock("svc", time.Minute); acquired {
+		t.Fatal("lock was acquired twice")
+	}
+
+	release()
+	if _, ok := server.value("test:lock:svc"); ok {
+		t.Fatal("release did not delete the lock")
+	}
+
+	if _, acquired, _ := store.TryLock("svc", time.Minute); !acquired {
+		t.Fatal("lock was not acquired after release")
+	}
+}
+
+func TestRedisTokenStoreReleaseKeepsForeignLock(t *testing.T) {
+	server := newFakeRedis(t)
+	store := newTestTokenStore(t, server, &GlobalConfig{})
+
+	release, acquired, err := store.TryLock("svc", time.Minute)
+	if err != nil || !acquired {
+		t.Fatalf("TryLock = %v, %v, want acquired", acquired, err)
+	}
+
+	// The lock expired and another replica acquired it
+	server.execute([]string{"SET", "test:lock:svc", "other-owner"})
+	release()
+
+	if value, _ := server.value("test:lock:svc"); value != "other-owner" {
+		t.Errorf("release deleted the lock of another owner")
+	}
+}
+
+func TestRedisTokenStoreAuthenticates(t *testing.T) {
+	server := newFakeRedis(t)
+	store := newTestTokenStore(t, server, &GlobalConfig{RedisUsername: "user", RedisPassword: "pass", RedisDB: 2})
+
+	if _, err := store.Get("svc"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	want := [][]string{{"AUTH", "user", "pass"}, {"SELECT", "2"}, {"GET", "test:svc"}}
+	if !reflect.DeepEqual(server.commands, want) {
+		t.Errorf("commands = %v, want %v", server.commands, want)
+	}
+}
+
+func TestNewRedisTokenStoreRejectsShortKey(t *testing.T) {
+	if _, err := NewRedisTokenStore(&GlobalConfig{Timeout: "1s"}, make([]byte, 16)); err == nil {
+		t.Error("NewRedisTokenStore accepted a 16 byte key")
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+		err   error
+	}{
+		{name: "simple string", input: "+OK\r\n", want: "OK"},
+		{name: "integer", input: ":42\r\n", want: int64(42)},
+		{name: "bulk string", input: "$5\r\nhe\r\no\r\n", want: "he\r\no"},
+		{name: "empty bulk string", input: "$0\r\n\r\n", want: ""},
+		{name: "nil bulk string", input: "$-1\r\n", err: errRedisNil},
+		{name: "array", input: "*3\r\n$1\r\na\r\n:1\r\n$-1\r\n", want: []interface{}{"a", int64(1), nil}},
+		{name: "nested array", input: "*1\r\n*1\r\n+x\r\n", want: []interface{}{[]interface{}{"x"}}},
+		{name: "nil array", input: "*-1\r\n", err: errRedisNil},
+		{name: "error", input: "-ERR wrong type\r\n", err: redisError("ERR wrong type")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRESP(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadRESPMalformed(t *testing.T) {
+	inputs := []string{
+		"OK\r\n",          // Missing type
+		"+OK\n",           // Missing carriage return
+		"$abc\r\nx\r\n",   // Invalid bulk length
+		"*x\r\n",          // Invalid array length
+		"$5\r\nabc\r\n",   // Truncated bulk string
+		":notanumber\r\n", // Invalid integer
+	}
+
+	for _, input := range inputs {
+		if _, err := readRESP(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("readRESP(%q) succeeded, want an error", input)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package traefik_token_injector
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenWriteBack stores freshly obtained tokens on their instance through a GraphQL mutation
+// Write-backs are queued and sent in the background, so they never block or fail a request
+type TokenWriteBack struct {
+	client *GraphQLClient
+	config *TokenWriteBackConfig
+	queue  chan tokenWriteBackItem
+
+	// Instance updated_at values produced by write-backs, per service
+	mu      sync.Mutex
+	written map[string]writtenUpdate
+}
+
+// tokenWriteBackItem is a token waiting to be written back
+type tokenWriteBackItem struct {
+	serviceId  string
+	token      string
+	ttl        *int
+	obtainedAt time.Time
+	updatedAt  int // Instance updated_at of the tag the token was cached with
+}
+
+// writtenUpdate maps the updated_at returned by a write-back to the updated_at the token was cached with
+type writtenUpdate struct {
+	updatedAt int
+	base      int
+}
+
+// NewTokenWriteBack creates a token write-back sending mutations through the GraphQL client
+func NewTokenWriteBack(client *GraphQLClient, config *TokenWriteBackConfig) *TokenWriteBack {
+	return &TokenWriteBack{
+		client:  client,
+		config:  config,
+		queue:   make(chan tokenWriteBackItem, config.QueueSize),
+		written: make(map[string]writtenUpdate),
+	}
+}
+
+// Start sends queued write-backs until ctx is done
+func (w *TokenWriteBack) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case item := <-w.queue:
+				if err := w.write(item); err != nil {
+					rootLogger.WithSecrets(item.token).Warn("Failed to write back token", "serviceId", item.serviceId, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Enqueue queues a token cached with tag for write-back without blocking
+// The token is dropped if the queue is full
+func (w *TokenWriteBack) Enqueue(serviceId string, token string, ttl *int, tag TokenTag) {
+	item := tokenWriteBackItem{serviceId: serviceId, token: token, ttl: ttl, obtainedAt: time.Now(), updatedAt: tag.UpdatedAt}
+
+	select {
+	case w.queue <- item:
+	default:
+		rootLogger.Warn("Token write-back queue is full, dropping token", "serviceId", serviceId)
+	}
+}
+
+// write sends the mutation storing a token on its instance and records the updated_at it produced
+func (w *TokenWriteBack) write(item tokenWriteBackItem) error {
+	resp, err := w.client.execute(buildWriteBackMutation(w.config, item))
+	if err != nil {
+		return err
+	}
+
+	if resp.Data != nil && resp.Data.WriteBack != nil && resp.Data.WriteBack.UpdatedAt != nil {
+		w.mu.Lock()
+		w.written[item.serviceId] = writtenUpdate{updatedAt: *resp.Data.WriteBack.UpdatedAt, base: item.updatedAt}
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+// OwnTag returns tag with an updated_at produced by this write-back replaced by the updated_at the token was cached with
+// Other changes to the instance keep their updated_at and still invalidate the cached token
+func (w *TokenWriteBack) OwnTag(serviceId string, tag TokenTag) TokenTag {
+	if w == nil {
+		return tag
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if written, ok := w.written[serviceId]; ok && written.updatedAt == tag.UpdatedAt {
+		tag.UpdatedAt = written.base
+	}
+	return tag
+}
+
+// writeBackVariables are the GraphQL variable names of the write-back values
+var writeBackVariables = map[string]string{
+	"id":         "id",
+	"token":      "token",
+	"token_ttl":  "tokenTtl",
+	"expires_at": "expiresAt",
+}
+
+// buildWriteBackMutation builds the mutation for a token
+// The values are sent as variables, so the token never appears in the query text logged by the control plane
+func buildWriteBackMutation(config *TokenWriteBackConfig, item tokenWriteBackItem) GraphQLRequest {
+	// Sort the arguments so the mutation is deterministic
+	arguments := make([]string, 0, len(config.Fields))
+	for argument := range config.Fields {
+		arguments = append(arguments, argument)
+	}
+	sort.Strings(arguments)
+
+	parts := make([]string, len(arguments))
+	variables := make(map[string]interface{})
+	var declarations []string
+	for i, argument := range arguments {
+		value := config.Fields[argument]
+		name := writeBackVariables[value]
+		parts[i] = argument + ": $" + name
+
+		// A value mapped to several arguments is declared once
+		if _, declared := variables[name]; !declared {
+			declarations = append(declarations, "$"+name+": "+config.GetVariableType(value))
+		}
+		variables[name] = writeBackValue(value, item)
+	}
+
+	// The result is aliased so the updated_at it returns can be decoded
+	mutation := fmt.Sprintf("mutation tokenWriteBack(%s) { writeBack: %s(%s)", strings.Join(declarations, ", "), config.Mutation, strings.Join(parts, ", "))
+	selection := strings.TrimSpace(config.Selection)
+	if config.UpdatedAtField != "" {
+		selection = strings.TrimSpace(selection + " updatedAt: " + config.UpdatedAtField)
+	}
+	if selection != "" {
+		mutation += " { " + selection + " }"
+	}
+	return GraphQLRequest{Query: mutation + " }", Variables: variables}
+}
+
+// writeBackValue returns the variable value of a write-back value, nil for null
+func writeBackValue(value string, item tokenWriteBackItem) interface{} {
+	switch value {
+	case "id":
+		return item.serviceId
+	case "token":
+		return item.token
+	case "token_ttl":
+		if item.ttl == nil {
+			return nil
+		}
+		return *item.ttl
+	case "expires_at":
+		if item.ttl == nil {
+			return nil
+		}
+		return item.obtainedAt.Unix() + int64(*item.ttl)
+	default:
+		return nil
+	}
+}
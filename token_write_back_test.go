@@ -0,0 +1,97 @@
+package traefik_token_injector
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildWriteBackMutation(t *testing.T) {
+	config := &TokenWriteBackConfig{
+		Mutation:       "updateInstanceToken",
+		Fields:         map[string]string{"_id": "id", "token": "token", "tokenExpiresAt": "expires_at", "expiry": "expires_at"},
+		Selection:      "_id",
+		UpdatedAtField: "updated_at",
+		VariableTypes:  map[string]string{"id": "String!"},
+	}
+	ttl := 60
+	item := tokenWriteBackItem{serviceId: "instance-1", token: "secret-token", ttl: &ttl, obtainedAt: time.Unix(1000, 0)}
+
+	request := buildWriteBackMutation(config, item)
+
+	want := "mutation tokenWriteBack($id: String!, $expiresAt: Int, $token: String!) { writeBack: updateInstanceToken(_id: $id, expiry: $expiresAt, token: $token, tokenExpiresAt: $expiresAt) { _id updatedAt: updated_at } }"
+	if request.Query != want {
+		t.Errorf("query = %q, want %q", request.Query, want)
+	}
+	if strings.Contains(request.Query, "secret-token") {
+		t.Error("the token is written into the query text")
+	}
+
+	wantVariables := map[string]interface{}{"id": "instance-1", "token": "secret-token", "expiresAt": int64(1060)}
+	if !reflect.DeepEqual(request.Variables, wantVariables) {
+		t.Errorf("variables = %v, want %v", request.Variables, wantVariables)
+	}
+}
+
+func TestBuildWriteBackMutationWithoutTTL(t *testing.T) {
+	config := &TokenWriteBackConfig{Mutation: "storeToken", Fields: map[string]string{"token": "token", "ttl": "token_ttl"}}
+	request := buildWriteBackMutation(config, tokenWriteBackItem{token: "secret-token"})
+
+	want := "mutation tokenWriteBack($token: String!, $tokenTtl: Int) { writeBack: storeToken(token: $token, ttl: $tokenTtl) }"
+	if request.Query != want {
+		t.Errorf("query = %q, want %q", request.Query, want)
+	}
+	if value, ok := request.Variables["tokenTtl"]; !ok || value != nil {
+		t.Errorf("tokenTtl = %v, want null", value)
+	}
+}
+
+func TestTokenWriteBackRecordsOwnUpdate(t *testing.T) {
+	var received GraphQLRequest
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		json.Unmarshal(data, &received)
+		io.WriteString(rw, `{"data": {"writeBack": {"_id": "svc", "updatedAt": 200}}}`)
+	}))
+	defer server.Close()
+
+	client, err := NewGraphQLClient(&GlobalConfig{GraphQLAPIURL: server.URL, GraphQLAuthType: "none", Timeout: "1s"})
+	if err != nil {
+		t.Fatalf("NewGraphQLClient: %v", err)
+	}
+	writeBack := NewTokenWriteBack(client, &TokenWriteBackConfig{
+		Mutation:       "updateInstanceToken",
+		Fields:         map[string]string{"_id": "id", "token": "token"},
+		UpdatedAtField: "updated_at",
+		QueueSize:      1,
+	})
+
+	if err := writeBack.write(tokenWriteBackItem{serviceId: "svc", token: "secret-token", updatedAt: 100}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if received.Variables["token"] != "secret-token" {
+		t.Errorf("variables = %v, want the token", received.Variables)
+	}
+
+	// The updated_at produced by the write-back maps back to the one the token was cached with
+	if tag := writeBack.OwnTag("svc", TokenTag{UpdatedAt: 200}); tag.UpdatedAt != 100 {
+		t.Errorf("OwnTag = %d, want 100", tag.UpdatedAt)
+	}
+	// Later changes and other services keep their updated_at
+	if tag := writeBack.OwnTag("svc", TokenTag{UpdatedAt: 300}); tag.UpdatedAt != 300 {
+		t.Errorf("OwnTag of a later change = %d, want 300", tag.UpdatedAt)
+	}
+	if tag := writeBack.OwnTag("other", TokenTag{UpdatedAt: 200}); tag.UpdatedAt != 200 {
+		t.Errorf("OwnTag of another service = %d, want 200", tag.UpdatedAt)
+	}
+
+	var disabled *TokenWriteBack
+	if tag := disabled.OwnTag("svc", TokenTag{UpdatedAt: 200}); tag.UpdatedAt != 200 {
+		t.Errorf("OwnTag without write-back = %d, want 200", tag.UpdatedAt)
+	}
+}
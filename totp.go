@@ -0,0 +1,81 @@
+package traefik_token_injector
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// GenerateTOTP generates a time-based one-time password as defined in RFC 6238
+func GenerateTOTP(totp *TotpType, at time.Time) (string, error) {
+	if totp == nil {
+		return "", fmt.Errorf("totp configuration is nil")
+	}
+
+	// Decode the base32 seed, padding is optional and spaces are ignored
+	secret := strings.ToUpper(strings.ReplaceAll(totp.Secret, " ", ""))
+	secret = strings.TrimRight(secret, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %w", err)
+	}
+	if len(key) == 0 {
+		return "", fmt.Errorf("totp secret is empty")
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToUpper(totp.Algorithm) {
+	case "", "SHA1":
+		newHash = sha1.New
+	case "SHA256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported totp algorithm: %s", totp.Algorithm)
+	}
+
+	digits := totp.GetDigits()
+	if digits < 6 || digits > 10 {
+		return "", fmt.Errorf("totp digits must be between 6 and 10, got %d", digits)
+	}
+
+	// Compute the HOTP value for the current time step (RFC 4226)
+	counter := uint64(at.Unix()) / uint64(totp.GetPeriod())
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(newHash, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := uint64(binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff)
+
+	modulo := uint64(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, code%modulo), nil
+}
+
+// GetDigits returns the number of digits of the generated codes, defaulting to 6
+func (t *TotpType) GetDigits() int {
+	if t.Digits == 0 {
+		return 6
+	}
+	return t.Digits
+}
+
+// GetPeriod returns the time step in seconds, defaulting to 30
+func (t *TotpType) GetPeriod() int {
+	if t.Period <= 0 {
+		return 30
+	}
+	return t.Period
+}
@@ -0,0 +1,88 @@
+package traefik_token_injector
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestGenerateTOTPRFC6238(t *testing.T) {
+	// Test vectors from RFC 6238 appendix B
+	sha1Seed := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	sha256Seed := base32.StdEncoding.EncodeToString([]byte("12345678901234567890123456789012"))
+
+	tests := []struct {
+		unix   int64
+		sha1   string
+		sha256 string
+	}{
+		{unix: 59, sha1: "94287082", sha256: "46119246"},
+		{unix: 1111111109, sha1: "07081804", sha256: "68084774"},
+		{unix: 1111111111, sha1: "14050471", sha256: "67062674"},
+		{unix: 1234567890, sha1: "89005924", sha256: "91819424"},
+		{unix: 2000000000, sha1: "69279037", sha256: "90698825"},
+		{unix: 20000000000, sha1: "65353130", sha256: "77737706"},
+	}
+
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0)
+
+		got, err := GenerateTOTP(&TotpType{Secret: sha1Seed, Algorithm: "SHA1", Digits: 8}, at)
+		if err != nil {
+			t.Fatalf("SHA1 at %d: %v", tt.unix, err)
+		}
+		if got != tt.sha1 {
+			t.Errorf("SHA1 at %d = %s, want %s", tt.unix, got, tt.sha1)
+		}
+
+		got, err = GenerateTOTP(&TotpType{Secret: sha256Seed, Algorithm: "SHA256", Digits: 8}, at)
+		if err != nil {
+			t.Fatalf("SHA256 at %d: %v", tt.unix, err)
+		}
+		if got != tt.sha256 {
+			t.Errorf("SHA256 at %d = %s, want %s", tt.unix, got, tt.sha256)
+		}
+	}
+}
+
+func TestGenerateTOTPDefaults(t *testing.T) {
+	// Lower case, unpadded and spaced seeds are accepted, 6 digits and a 30 second period are the defaults
+	seed := "gezd gnbv gy3t qojq gezd gnbv gy3t qojq"
+	got, err := GenerateTOTP(&TotpType{Secret: seed}, time.Unix(59, 0))
+	if err != nil {
+		t.Fatalf("GenerateTOTP: %v", err)
+	}
+	if got != "287082" {
+		t.Errorf("GenerateTOTP = %s, want 287082", got)
+	}
+
+	// Codes stay the same within a period
+	next, _ := GenerateTOTP(&TotpType{Secret: seed}, time.Unix(31, 0))
+	if next != got {
+		t.Errorf("code changed within the period: %s, want %s", next, got)
+	}
+}
+
+func TestGenerateTOTPErrors(t *testing.T) {
+	seed := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		name string
+		totp *TotpType
+	}{
+		{name: "nil configuration", totp: nil},
+		{name: "invalid seed", totp: &TotpType{Secret: "not base32!"}},
+		{name: "empty seed", totp: &TotpType{Secret: ""}},
+		{name: "unsupported algorithm", totp: &TotpType{Secret: seed, Algorithm: "MD5"}},
+		{name: "too few digits", totp: &TotpType{Secret: seed, Digits: 4}},
+		{name: "too many digits", totp: &TotpType{Secret: seed, Digits: 11}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := GenerateTOTP(tt.totp, time.Unix(59, 0)); err == nil {
+				t.Error("GenerateTOTP succeeded, want an error")
+			}
+		})
+	}
+}
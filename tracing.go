@@ -0,0 +1,355 @@
+package traefik_token_injector
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds of the OTLP data model
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// spanContextKey is the context key of the current span
+type spanContextKey struct{}
+
+// Span is a timed operation of a trace
+// All methods are safe to call on a nil span, which is used when tracing is disabled
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	mu         sync.Mutex
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        string
+	ended      bool
+}
+
+// Tracer records spans and exports them in batches to an OTLP/HTTP collector as JSON
+type Tracer struct {
+	config   *TracingConfig
+	client   *http.Client
+	interval time.Duration
+	queue    chan *Span
+}
+
+// NewTracer creates a tracer exporting to the configured collector
+func NewTracer(config *TracingConfig, timeout time.Duration) (*Tracer, error) {
+	interval, err := config.GetFlushInterval()
+	if err != nil {
+		return nil, fmt.Errorf("invalid flush_interval: %w", err)
+	}
+
+	return &Tracer{
+		config:   config,
+		client:   &http.Client{Timeout: timeout},
+		interval: interval,
+		queue:    make(chan *Span, config.QueueSize),
+	}, nil
+}
+
+// Start exports finished spans until ctx is done, flushing the pending spans before returning
+func (t *Tracer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+
+		var batch []*Span
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := t.export(batch); err != nil {
+				rootLogger.Warn("Failed to export spans", "count", len(batch), "error", err)
+			}
+			batch = nil
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				for {
+					select {
+					case span := <-t.queue:
+						batch = append(batch, span)
+					default:
+						flush()
+						return
+					}
+				}
+			case span := <-t.queue:
+				batch = append(batch, span)
+				if len(batch) >= t.config.BatchSize {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// StartRequest starts the server span of an incoming request, continuing the trace of its traceparent header
+// Returns the request carrying the span in its context
+func (t *Tracer) StartRequest(req *http.Request, name string) (*http.Request, *Span) {
+	if t == nil {
+		return req, nil
+	}
+
+	span := &Span{tracer: t, sampled: true, name: name, kind: SpanKindServer, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+		span.traceID, span.parentID, span.sampled = traceID, parentID, sampled
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.Path)
+	return req.WithContext(context.WithValue(req.Context(), spanContextKey{}, span)), span
+}
+
+// StartSpan starts a child span of the span in ctx
+// Returns a nil span if ctx carries no span, i.e. tracing is disabled
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:   parent.tracer,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		sampled:  parent.sampled,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// SpanFromContext returns the current span of ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// InjectTraceparent sets the traceparent header of an outgoing request to the current span of ctx
+func InjectTraceparent(ctx context.Context, header http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		header.Set("traceparent", span.Traceparent())
+	}
+}
+
+// SetAttribute sets a string attribute of the span
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = value
+}
+
+// RecordError marks the span as failed
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = redactSecrets(err.Error())
+}
+
+// End finishes the span and queues it for export if the trace is sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if !s.sampled {
+		return
+	}
+	select {
+	case s.tracer.queue <- s:
+	default:
+		// Spans are dropped rather than blocking requests when the collector falls behind
+	}
+}
+
+// Traceparent returns the W3C traceparent header value identifying the span
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a W3C traceparent header value
+func parseTraceparent(value string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, false, false
+	}
+
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// OTLP/HTTP JSON encoding of spans
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// export sends a batch of spans to the collector
+func (t *Tracer) export(spans []*Span) error {
+	encoded := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		encoded[i] = span.otlp()
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{newOtlpAttribute("service.name", t.config.ServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "traefik-token-injector"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", t.config.Endpoint, bytes.NewBuffer(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send spans: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlp returns the OTLP JSON encoding of a finished span
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	encoded := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+	}
+	if s.parentID != [8]byte{} {
+		encoded.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		encoded.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	for key, value := range s.attributes {
+		encoded.Attributes = append(encoded.Attributes, newOtlpAttribute(key, value))
+	}
+	return encoded
+}
+
+// newOtlpAttribute returns a string attribute
+func newOtlpAttribute(key string, value string) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	attribute.Value.StringValue = value
+	return attribute
+}
@@ -0,0 +1,265 @@
+package traefik_token_injector
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// otlpExport is the part of an OTLP/HTTP JSON export request checked by the tests
+type otlpExport struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// collectedExport is an export request received by the stand-in collector
+type collectedExport struct {
+	header  http.Header
+	payload otlpExport
+}
+
+// newTestCollector starts a stand-in OTLP/HTTP collector answering with status and
+// returns the channel its export requests are sent to
+func newTestCollector(t *testing.T, status int) (*httptest.Server, chan collectedExport) {
+	t.Helper()
+	exports := make(chan collectedExport, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var payload otlpExport
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Errorf("collector received invalid JSON: %v", err)
+		}
+		exports <- collectedExport{header: req.Header, payload: payload}
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, exports
+}
+
+// newTestTracer creates a tracer exporting to endpoint, started until the test ends
+func newTestTracer(t *testing.T, endpoint string, batchSize int) *Tracer {
+	t.Helper()
+	tracer, err := NewTracer(&TracingConfig{
+		Endpoint:      endpoint,
+		ServiceName:   "test-service",
+		Headers:       map[string]string{"X-Api-Key": "collector-key"},
+		BatchSize:     batchSize,
+		QueueSize:     10,
+		FlushInterval: "1h",
+	}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewTracer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	tracer.Start(ctx)
+	return tracer
+}
+
+// attributes returns the attributes of a span keyed by name
+func attributes(span otlpSpan) map[string]string {
+	values := make(map[string]string)
+	for _, attribute := range span.Attributes {
+		values[attribute.Key] = attribute.Value.StringValue
+	}
+	return values
+}
+
+func TestTracerExportsSpans(t *testing.T) {
+	collector, exports := newTestCollector(t, http.StatusOK)
+	tracer := newTestTracer(t, collector.URL, 2)
+
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	req, root := tracer.StartRequest(req, "token-injector")
+	ctx, child := StartSpan(req.Context(), "login", SpanKindClient)
+
+	outgoing := http.Header{}
+	InjectTraceparent(ctx, outgoing)
+	if want := child.Traceparent(); outgoing.Get("traceparent") != want {
+		t.Errorf("traceparent = %q, want %q", outgoing.Get("traceparent"), want)
+	}
+
+	child.SetAttribute("service.id", "svc")
+	child.RecordError(errors.New("login failed: Bearer abc.def"))
+	child.End()
+	root.End()
+
+	var export collectedExport
+	select {
+	case export = <-exports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the collector received no spans")
+	}
+
+	if got := export.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := export.header.Get("X-Api-Key"); got != "collector-key" {
+		t.Errorf("X-Api-Key = %q, want the configured header", got)
+	}
+
+	if len(export.payload.ResourceSpans) != 1 || len(export.payload.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected payload: %+v", export.payload)
+	}
+	resource := export.payload.ResourceSpans[0]
+	if len(resource.Resource.Attributes) != 1 || resource.Resource.Attributes[0].Value.StringValue != "test-service" {
+		t.Errorf("resource attributes = %+v, want service.name test-service", resource.Resource.Attributes)
+	}
+
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	login, server := spans[0], spans[1]
+
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("server span = %s/%s, want the incoming trace", server.TraceID, server.ParentSpanID)
+	}
+	if server.Kind != SpanKindServer || server.Status.Code != 1 {
+		t.Errorf("server span kind %d status %d, want a successful server span", server.Kind, server.Status.Code)
+	}
+	if got := attributes(server); got["http.method"] != "GET" || got["http.target"] != "/api/users" {
+		t.Errorf("server span attributes = %v", got)
+	}
+
+	if login.TraceID != server.TraceID || login.ParentSpanID != server.SpanID {
+		t.Errorf("login span is not a child of the server span")
+	}
+	if login.Name != "login" || login.Kind != SpanKindClient {
+		t.Errorf("login span = %s kind %d", login.Name, login.Kind)
+	}
+	if login.Status.Code != 2 || login.Status.Message != "login failed: Bearer [REDACTED]" {
+		t.Errorf("login span status = %+v, want a redacted error", login.Status)
+	}
+	if attributes(login)["service.id"] != "svc" {
+		t.Errorf("login span attributes = %v", attributes(login))
+	}
+}
+
+func TestTracerFlushesOnShutdown(t *testing.T) {
+	collector, exports := newTestCollector(t, http.StatusOK)
+	tracer, err := NewTracer(&TracingConfig{Endpoint: collector.URL, BatchSize: 100, QueueSize: 10, FlushInterval: "1h"}, 2*time.Second)
+	if err != nil {
+		t.Fatalf("NewTracer: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tracer.Start(ctx)
+
+	_, span := tracer.StartRequest(httptest.NewRequest("GET", "/", nil), "request")
+	span.End()
+	cancel()
+
+	select {
+	case export := <-exports:
+		if spans := export.payload.ResourceSpans[0].ScopeSpans[0].Spans; len(spans) != 1 {
+			t.Errorf("got %d spans, want 1", len(spans))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending spans were not flushed on shutdown")
+	}
+}
+
+func TestTracerSkipsUnsampledTraces(t *testing.T) {
+	tracer, err := NewTracer(&TracingConfig{Endpoint: "http://127.0.0.1:0", BatchSize: 1, QueueSize: 10, FlushInterval: "1h"}, time.Second)
+	if err != nil {
+		t.Fatalf("NewTracer: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	req, root := tracer.StartRequest(req, "request")
+	_, child := StartSpan(req.Context(), "login", SpanKindClient)
+	child.End()
+	root.End()
+
+	if len(tracer.queue) != 0 {
+		t.Errorf("%d spans of an unsampled trace were queued", len(tracer.queue))
+	}
+	if traceparent := child.Traceparent(); traceparent[len(traceparent)-2:] != "00" {
+		t.Errorf("traceparent = %q, want the unsampled flag", traceparent)
+	}
+}
+
+func TestTracerExportError(t *testing.T) {
+	collector, _ := newTestCollector(t, http.StatusServiceUnavailable)
+	tracer, err := NewTracer(&TracingConfig{Endpoint: collector.URL, BatchSize: 1, QueueSize: 1, FlushInterval: "1h"}, time.Second)
+	if err != nil {
+		t.Fatalf("NewTracer: %v", err)
+	}
+
+	_, span := tracer.StartRequest(httptest.NewRequest("GET", "/", nil), "request")
+	span.End()
+	if err := tracer.export([]*Span{span}); err == nil {
+		t.Error("export succeeded although the collector failed")
+	}
+}
+
+func TestDisabledTracing(t *testing.T) {
+	var tracer *Tracer
+	req := httptest.NewRequest("GET", "/", nil)
+
+	got, span := tracer.StartRequest(req, "request")
+	if got != req || span != nil {
+		t.Error("a nil tracer started a span")
+	}
+	if _, child := StartSpan(req.Context(), "login", SpanKindClient); child != nil {
+		t.Error("a span was started without a parent")
+	}
+
+	// Methods of a nil span are no-ops
+	span.SetAttribute("key", "value")
+	span.RecordError(errors.New("failed"))
+	span.End()
+
+	header := http.Header{}
+	InjectTraceparent(req.Context(), header)
+	if header.Get("traceparent") != "" {
+		t.Error("traceparent was set without a span")
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{name: "sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true, sampled: true},
+		{name: "not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ok: true},
+		{name: "future version with extra fields", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ok: true, sampled: true},
+		{name: "version 00 with extra fields", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{name: "invalid version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "zero trace id", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero parent id", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "short trace id", value: "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01"},
+		{name: "invalid hex", value: "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"},
+		{name: "invalid flags", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz"},
+		{name: "empty", value: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traceID, parentID, sampled, ok := parseTraceparent(tt.value)
+			if ok != tt.ok || sampled != tt.sampled {
+				t.Fatalf("got ok %v sampled %v, want ok %v sampled %v", ok, sampled, tt.ok, tt.sampled)
+			}
+			if ok && (hex.EncodeToString(traceID[:]) != tt.value[3:35] || hex.EncodeToString(parentID[:]) != tt.value[36:52]) {
+				t.Errorf("got %x-%x, want the ids of %s", traceID, parentID, tt.value)
+			}
+		})
+	}
+}
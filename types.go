@@ -22,14 +22,35 @@ type GraphQLError struct {
 	Path    []string `json:"path,omitempty"`
 }
 
+// SearchCondition represents a single search condition of the getInstances queryInput
+type SearchCondition struct {
+	Field    string `json:"field" yaml:"field"`
+	Value    string `json:"value" yaml:"value"`
+	Kind     string `json:"kind" yaml:"kind"`         // ID, STRING, ... (default: STRING)
+	Operator string `json:"operator" yaml:"operator"` // EQ, ... (default: EQ)
+}
+
 // InstanceData wraps the getInstances query response
 type InstanceData struct {
 	GetInstances *InstanceConnection `json:"getInstances"`
+	WriteBack    *WriteBackResult    `json:"writeBack"` // Result of a token write-back mutation
+}
+
+// WriteBackResult is the result of a token write-back mutation, selected under the writeBack alias
+type WriteBackResult struct {
+	UpdatedAt *int `json:"updatedAt"` // Instance updated_at after the write-back
 }
 
 // InstanceConnection represents the paginated connection
 type InstanceConnection struct {
-	Edges []InstanceEdge `json:"edges"`
+	Edges    []InstanceEdge `json:"edges"`
+	PageInfo *PageInfo      `json:"pageInfo"`
+}
+
+// PageInfo represents the Relay pagination info of a connection
+type PageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
 }
 
 // InstanceEdge represents an edge in the connection
@@ -39,25 +60,28 @@ type InstanceEdge struct {
 
 // InstanceType represents the instance data from GraphQL
 type InstanceType struct {
-	ID          string           `json:"_id"`
-	Name        string           `json:"name"`
-	Type        string           `json:"type"`
-	ServiceHost string           `json:"service_host"`
-	ServicePath string           `json:"service_path"`
-	RemoteHost  string           `json:"remote_host"`
-	RemotePath  string           `json:"remote_path"`
-	VersionID   string           `json:"version_id"`
-	Operations  []string         `json:"operations"`
-	Headers     []HeaderType     `json:"headers"`
-	Credentials *CredentialsType `json:"credentials"`
-	CreatedAt   int              `json:"created_at"`
-	UpdatedAt   int              `json:"updated_at"`
-}
-
-// HeaderType represents a key-value header pair
+	ID              string           `json:"_id"`
+	Name            string           `json:"name"`
+	Type            string           `json:"type"`
+	ServiceHost     string           `json:"service_host"`
+	ServicePath     string           `json:"service_path"`
+	RemoteHost      string           `json:"remote_host"`
+	RemotePath      string           `json:"remote_path"`
+	VersionID       string           `json:"version_id"`
+	Operations      []string         `json:"operations"`
+	Headers         []HeaderType     `json:"headers"`
+	ResponseHeaders []HeaderType     `json:"response_headers"`
+	Credentials     *CredentialsType `json:"credentials"`
+	CreatedAt       int              `json:"created_at"`
+	UpdatedAt       int              `json:"updated_at"`
+}
+
+// HeaderType represents a key-value header pair and the operation applied with it
 type HeaderType struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Operation string `json:"operation"` // set (default), append, set_if_absent, remove
+	Template  bool   `json:"template"`  // The value contains {{ ... }} expressions, otherwise it is used literally
 }
 
 // CredentialsType represents authentication credentials
@@ -68,19 +92,47 @@ type CredentialsType struct {
 	Token          *string               `json:"token"`          // Pre-existing token (nullable)
 	TokenLocation  string                `json:"tokenLocation"`  // Path to token in response (e.g., "data.login.token")
 	TokenTtl       *int                  `json:"tokenTtl"`       // Token TTL in seconds (nullable)
+	TokenExpiresAt *int64                `json:"tokenExpiresAt"` // Expiry of the pre-existing token as a Unix timestamp, read back from token_write_back.expires_at_field (nullable)
 	ApiKey         string                `json:"apiKey"`         // API key for APITOKEN auth
 	EndpointData   *EndpointConnection   `json:"endpointData"`   // Authentication endpoint data
+	LoginSteps     []LoginStepType       `json:"loginSteps"`     // Multi-step login chain (optional)
 }
 
 // CredentialsPairType represents a key-value credential pair
 type CredentialsPairType struct {
-	Key   string `json:"key"`   // Supports nested paths like "user.credentials.username"
-	Value string `json:"value"` // The credential value
+	Key      string    `json:"key"`      // Supports nested paths like "user.credentials.username"
+	Value    string    `json:"value"`    // The credential value
+	Totp     *TotpType `json:"totp"`     // TOTP seed, the value is generated when the request is built (nullable)
+	Template bool      `json:"template"` // The value contains {{ ... }} expressions, otherwise it is used literally
+}
+
+// TotpType represents a TOTP seed used to generate second factor codes (RFC 6238)
+type TotpType struct {
+	Secret    string `json:"secret"`    // Base32 encoded seed
+	Algorithm string `json:"algorithm"` // SHA1 (default) or SHA256
+	Digits    int    `json:"digits"`    // Number of digits (default: 6)
+	Period    int    `json:"period"`    // Time step in seconds (default: 30)
+}
+
+// LoginStepType represents a single step of a multi-step login chain
+type LoginStepType struct {
+	Name           string                `json:"name"`
+	Endpoint       EndpointNode          `json:"endpoint"`       // REST endpoint or GraphQL operation to call
+	CredentialData []CredentialsPairType `json:"credentialData"` // Step specific values, may reference values of earlier steps as ${name}
+	Extract        []StepExtractType     `json:"extract"`        // Values to extract from the step response
+}
+
+// StepExtractType describes a value extracted from a login step response
+type StepExtractType struct {
+	Name     string `json:"name"`     // Name used to reference the value in later steps
+	Source   string `json:"source"`   // body, header, cookie
+	Location string `json:"location"` // Path in the response body, header name or cookie name
 }
 
 // EndpointConnection represents the endpoint data connection
 type EndpointConnection struct {
-	Edges []EndpointEdge `json:"edges"`
+	Edges    []EndpointEdge `json:"edges"`
+	PageInfo *PageInfo      `json:"pageInfo"`
 }
 
 // EndpointEdge represents an edge in the endpoint connection
@@ -113,6 +165,17 @@ func (e *EndpointNode) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON encodes the union type as the endpoint or operation it holds
+func (e EndpointNode) MarshalJSON() ([]byte, error) {
+	if e.EndpointType != nil {
+		return json.Marshal(e.EndpointType)
+	}
+	if e.GqlOperationType != nil {
+		return json.Marshal(e.GqlOperationType)
+	}
+	return []byte("null"), nil
+}
+
 // EndpointType represents a REST endpoint
 type EndpointType struct {
 	ID           string                 `json:"_id"`
@@ -133,6 +196,7 @@ type GqlOperationType struct {
 	Description   string                 `json:"description"`
 	Arguments     map[string]interface{} `json:"arguments"`
 	Result        string                 `json:"result"`
+	Url           string                 `json:"url"` // GraphQL endpoint the operation is sent to
 }
 
 // ContentAttributeType represents a parameter or attribute
@@ -155,7 +219,26 @@ type ContentType struct {
 
 // CachedToken represents a cached authentication token
 type CachedToken struct {
+	ServiceId string
 	Token     string
-	ExpiresAt *int64 // Unix timestamp, nil if no expiration
-	RefreshAt *int64 // Unix timestamp when to refresh (TTL - buffer)
+	ExpiresAt *int64   // Unix timestamp, nil if no expiration
+	RefreshAt *int64   // Unix timestamp when to refresh (TTL - buffer)
+	Tag       TokenTag // Instance state the token was obtained for
+	Source    string   // Where the token came from, one of the TokenSource constants
+}
+
+// Sources of cached tokens
+const (
+	TokenSourceLogin        = "login"         // Obtained from an authentication endpoint or login chain
+	TokenSourceControlPlane = "control_plane" // Provided by the instance credentials
+	TokenSourceStore        = "store"         // Obtained by another replica through the shared token store
+	TokenSourceFile         = "file"          // Restored from the encrypted token file
+)
+
+// TokenTag identifies the instance state a token was obtained for
+// A cached token is invalidated when the tag of the current instance differs
+type TokenTag struct {
+	VersionID   string // Instance version_id
+	UpdatedAt   int    // Instance updated_at
+	Fingerprint string // Fingerprint of the instance credentials
 }
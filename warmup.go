@@ -0,0 +1,209 @@
+package traefik_token_injector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Warmup modes
+const (
+	WarmupBackground = "background" // New returns immediately, the warmup runs in the background
+	WarmupBlocking   = "blocking"   // New waits for the warmup and fails on configuration errors
+)
+
+// Service readiness states
+const (
+	ReadinessPending  = "pending"  // Warmup has not finished yet
+	ReadinessReady    = "ready"    // The last warmup or request obtained a token
+	ReadinessDegraded = "degraded" // The last request was served by the degradation policy
+	ReadinessFailed   = "failed"   // The last warmup or request failed
+)
+
+// ServiceReadiness is the readiness of a service served by a middleware
+type ServiceReadiness struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Readiness keeps the readiness of each service of a middleware
+type Readiness struct {
+	mu       sync.Mutex
+	services map[string]ServiceReadiness
+}
+
+// NewReadiness creates an empty readiness record
+func NewReadiness() *Readiness {
+	return &Readiness{services: make(map[string]ServiceReadiness)}
+}
+
+// Set stores the readiness of a service, err describes why it is not ready
+func (r *Readiness) Set(serviceId string, status string, err error) {
+	if serviceId == "" {
+		return
+	}
+
+	readiness := ServiceReadiness{Status: status, CheckedAt: time.Now()}
+	if err != nil {
+		readiness.Error = redactSecrets(err.Error())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.services[serviceId] = readiness
+}
+
+// All returns a copy of the readiness keyed by service ID
+func (r *Readiness) All() map[string]ServiceReadiness {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make(map[string]ServiceReadiness, len(r.services))
+	for serviceId, readiness := range r.services {
+		all[serviceId] = readiness
+	}
+	return all
+}
+
+// Ready reports whether every known service is ready
+func (r *Readiness) Ready() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, readiness := range r.services {
+		if readiness.Status != ReadinessReady {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateCredentials checks that a token can be obtained with the credentials without calling any endpoint
+func ValidateCredentials(credentials *CredentialsType) error {
+	if credentials == nil {
+		return nil
+	}
+
+	switch credentials.AuthType {
+	case "NONE":
+		return nil
+
+	case "BASIC":
+		var username, password string
+		for _, pair := range credentials.CredentialData {
+			if pair.Key == "username" || pair.Key == "user" {
+				username = pair.Value
+			}
+			if pair.Key == "password" || pair.Key == "pass" {
+				password = pair.Value
+			}
+		}
+		if username == "" || password == "" {
+			return fmt.Errorf("username or password not found in credential data")
+		}
+		return nil
+
+	case "APITOKEN":
+		if credentials.ApiKey == "" {
+			return fmt.Errorf("apiKey is empty")
+		}
+		return nil
+
+	case "LOGIN":
+		if credentials.TokenLocation == "" {
+			return fmt.Errorf("tokenLocation is not set")
+		}
+		if len(credentials.LoginSteps) > 0 {
+			return nil
+		}
+		if credentials.EndpointData == nil || len(credentials.EndpointData.Edges) == 0 {
+			return fmt.Errorf("no authentication endpoint configured")
+		}
+		for i, edge := range credentials.EndpointData.Edges {
+			if (credentials.EndpointType == "REST" && edge.Node.EndpointType == nil) ||
+				(credentials.EndpointType == "GRAPHQL" && edge.Node.GqlOperationType == nil) ||
+				(credentials.EndpointType != "REST" && credentials.EndpointType != "GRAPHQL") {
+				return fmt.Errorf("%s does not match endpointType %q", describeEndpoint(i, edge.Node), credentials.EndpointType)
+			}
+			if edge.Node.GqlOperationType != nil && edge.Node.GqlOperationType.Url == "" {
+				return fmt.Errorf("%s has no url", describeEndpoint(i, edge.Node))
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported auth type: %s", credentials.AuthType)
+	}
+}
+
+// startWarmup runs the warmup of the middleware in the background
+// In blocking mode it waits for the warmup and returns configuration errors; outages only leave the service not ready
+func (t *TokenInjector) startWarmup(ctx context.Context) error {
+	key := t.readinessKey("")
+	t.readiness.Set(key, ReadinessPending, nil)
+
+	// The timeout is checked by Config.Validate
+	timeout, _ := t.config.Warmup.GetTimeout()
+	done := make(chan error, 1)
+	go func() {
+		warmupCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err := t.warmup(warmupCtx)
+		if err != nil {
+			t.readiness.Set(key, ReadinessFailed, err)
+			t.logger.Warn("Warmup failed", "problem", ClassifyError(err), "error", err)
+		} else {
+			t.readiness.Set(key, ReadinessReady, nil)
+			t.logger.Info("Warmup completed")
+		}
+		done <- err
+	}()
+
+	if t.config.Warmup.GetMode() != WarmupBlocking {
+		return nil
+	}
+	if err := <-done; err != nil && !degradable(ClassifyError(err)) {
+		return err
+	}
+	return nil
+}
+
+// warmup prefetches the instance of the middleware, validates its configuration and obtains the first token
+func (t *TokenInjector) warmup(ctx context.Context) error {
+	instance, err := t.fetchConfiguredInstance(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch instance: %w", err)
+	}
+	if err := ValidateHeaders(instance.Headers); err != nil {
+		return fmt.Errorf("invalid request headers: %w", err)
+	}
+	if err := ValidateHeaders(instance.ResponseHeaders); err != nil {
+		return fmt.Errorf("invalid response headers: %w", err)
+	}
+	if instance.Credentials == nil {
+		return nil
+	}
+
+	// Warmup errors are kept by the readiness, so credential values are removed first
+	logger := t.logger.WithSecrets(credentialSecrets(instance.Credentials)...)
+	if err := ValidateCredentials(instance.Credentials); err != nil {
+		return logger.RedactError(fmt.Errorf("invalid credentials configuration: %w", err))
+	}
+
+	serviceId := instance.ID
+	if serviceId == "" {
+		serviceId = t.config.ServiceId
+	}
+
+	token, err := t.authHandler.GetAuthToken(ctx, serviceId, instance.Credentials, NewTokenTag(instance))
+	if err != nil {
+		return logger.RedactError(err)
+	}
+	if t.stale != nil {
+		t.stale.Record(t.staleKey(serviceId), instance, token)
+	}
+	return nil
+}